@@ -0,0 +1,530 @@
+package main
+
+import (
+  "crypto/sha256"
+  "debug/elf"
+  "debug/macho"
+  "debug/pe"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  PCH_EXT = ".pch"
+  TMP_EXT = ".tmp"
+
+  STORE_ROOT = "<store>"
+)
+
+// an object or a pch, along with its manifest and depfile, or a file in the shared object store
+type CacheEntry struct {
+  Key      string // path of the object relative to the cache dir (hash of the source path, or base64 encoded source path for older entries)
+  Source   string
+  Root     string // empty if the manifest is missing, STORE_ROOT for entries of the object store
+  Legacy   bool   // keyed by the base64 encoded source path, these entries are no longer used
+  Files    []string
+  Size     int64
+  LastUsed time.Time
+}
+
+func cacheEntryKey(name string) string {
+  for _, ext := range []string{TMP_EXT, MANIFEST_EXT, DEPFILE_EXT, PCH_EXT} {
+    name = strings.TrimSuffix(name, ext)
+  }
+
+  return name
+}
+
+func ListCacheEntries(cacheDir string) ([]*CacheEntry, error) {
+  res, err := listSlotEntries(cacheDir, "")
+  if err != nil {
+    return nil, err
+  }
+
+  profiles, err := ioutil.ReadDir(filepath.Join(cacheDir, PROFILES_DIR_REL))
+  if err != nil && !os.IsNotExist(err) {
+    return nil, err
+  }
+
+  for _, info := range profiles {
+    if !info.IsDir() {
+      continue
+    }
+
+    profileEntries, err := listSlotEntries(cacheDir, filepath.Join(PROFILES_DIR_REL, info.Name()))
+    if err != nil {
+      return nil, err
+    }
+
+    res = append(res, profileEntries...)
+  }
+
+  storeEntries, err := listStoreEntries(filepath.Join(cacheDir, STORE_DIR_REL))
+  if err != nil {
+    return nil, err
+  }
+
+  res = append(res, storeEntries...)
+
+  sort.Slice(res, func(i, j int) bool {
+    return res[i].Key < res[j].Key
+  })
+
+  return res, nil
+}
+
+// objects and pchs in cacheDir/rel, keys are relative to cacheDir
+func listSlotEntries(cacheDir string, rel string) ([]*CacheEntry, error) {
+  dir := filepath.Join(cacheDir, rel)
+
+  infos, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+
+  entries := make(map[string]*CacheEntry)
+
+  for _, info := range infos {
+    if info.IsDir() {
+      continue
+    }
+
+    key := filepath.Join(rel, cacheEntryKey(info.Name()))
+
+    entry, ok := entries[key]
+    if !ok {
+      entry = &CacheEntry{key, "", "", false, make([]string, 0), 0, time.Time{}}
+      entries[key] = entry
+    }
+
+    entry.Files = append(entry.Files, filepath.Join(dir, info.Name()))
+    entry.Size += info.Size()
+
+    if info.ModTime().After(entry.LastUsed) {
+      entry.LastUsed = info.ModTime()
+    }
+  }
+
+  res := make([]*CacheEntry, 0)
+
+  for _, entry := range entries {
+    for _, dst := range []string{entry.Path(cacheDir), entry.Path(cacheDir) + PCH_EXT} {
+      if m, err := ReadManifest(dst); err == nil {
+        entry.Root = m.Root
+        entry.Source = m.Source
+      }
+    }
+
+    if !isHashKey(filepath.Base(entry.Key)) {
+      entry.Legacy = true
+
+      // hash keys are valid base64 as well, so only abs paths are accepted
+      if b, err := base64.URLEncoding.DecodeString(filepath.Base(entry.Key)); err == nil && entry.Source == "" {
+        if source := string(b); filepath.IsAbs(source) && filepath.Clean(source) == source {
+          entry.Source = source
+        }
+      }
+    }
+
+    res = append(res, entry)
+  }
+
+  return res, nil
+}
+
+// every object and every manifest in the store is a separate entry
+func listStoreEntries(storeDir string) ([]*CacheEntry, error) {
+  res := make([]*CacheEntry, 0)
+
+  for _, sub := range []string{STORE_OBJECTS_REL, STORE_MANIFESTS_REL} {
+    dir := filepath.Join(storeDir, sub)
+
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+      if os.IsNotExist(err) {
+        continue
+      }
+
+      return nil, err
+    }
+
+    for _, info := range infos {
+      if info.IsDir() {
+        continue
+      }
+
+      key := filepath.Join(STORE_DIR_REL, sub, info.Name())
+      path := filepath.Join(dir, info.Name())
+
+      res = append(res, &CacheEntry{key, "", STORE_ROOT, false, []string{path}, info.Size(), info.ModTime()})
+    }
+  }
+
+  return res, nil
+}
+
+// see ObjPath
+func isHashKey(name string) bool {
+  b, err := hex.DecodeString(name)
+
+  return err == nil && len(b) == sha256.Size
+}
+
+func (e *CacheEntry) Name() string {
+  if e.Source != "" {
+    return e.Source
+  }
+
+  return e.Key
+}
+
+func (e *CacheEntry) Path(cacheDir string) string {
+  return filepath.Join(cacheDir, e.Key)
+}
+
+func (e *CacheEntry) Remove() error {
+  for _, path := range e.Files {
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (e *CacheEntry) IsStoreEntry() bool {
+  return e.Root == STORE_ROOT
+}
+
+func (e *CacheEntry) BelongsTo(root string) bool {
+  if e.Root != "" {
+    return e.Root == root
+  }
+
+  return strings.HasPrefix(e.Source, root + string(filepath.Separator))
+}
+
+// returns a description of the problem, or an empty string if the entry looks fine
+func (e *CacheEntry) Verify(cacheDir string) string {
+  if e.IsStoreEntry() {
+    return e.verifyStoreEntry(cacheDir)
+  }
+
+  hasDst := false
+
+  for _, dst := range []string{e.Path(cacheDir), e.Path(cacheDir) + PCH_EXT} {
+    info, err := os.Stat(dst)
+    if err != nil {
+      continue
+    }
+
+    hasDst = true
+
+    if info.Size() == 0 {
+      return filepath.Base(dst) + " is empty"
+    }
+
+    if _, err := ReadManifest(dst); err != nil {
+      return filepath.Base(dst) + " has a missing or invalid manifest"
+    }
+
+    if !strings.HasSuffix(dst, PCH_EXT) {
+      if problem := VerifyObject(dst, info.Size()); problem != "" {
+        return filepath.Base(dst) + " " + problem
+      }
+    }
+  }
+
+  if !hasDst {
+    return "object is missing"
+  }
+
+  return ""
+}
+
+func (e *CacheEntry) verifyStoreEntry(cacheDir string) string {
+  path := e.Path(cacheDir)
+
+  if strings.HasSuffix(path, TMP_EXT) {
+    return "is an incomplete write"
+  }
+
+  if filepath.Base(filepath.Dir(path)) == STORE_MANIFESTS_REL {
+    if candidates, err := ReadStoreManifest(filepath.Base(path)); err != nil || len(candidates) == 0 {
+      return "is an invalid store manifest"
+    }
+
+    return ""
+  }
+
+  if e.Size == 0 {
+    return "is empty"
+  }
+
+  return VerifyObject(path, e.Size)
+}
+
+// objects in unknown formats are assumed to be fine
+func VerifyObject(path string, size int64) string {
+  fd, err := os.Open(path)
+  if err != nil {
+    return err.Error()
+  }
+
+  defer fd.Close()
+
+  magic := make([]byte, 4)
+  if _, err := fd.ReadAt(magic, 0); err != nil {
+    return "is truncated"
+  }
+
+  switch {
+  case string(magic) == elf.ELFMAG:
+    ef, err := elf.NewFile(fd)
+    if err != nil {
+      return "is corrupt (" + err.Error() + ")"
+    }
+
+    for _, s := range ef.Sections {
+      if s.Type != elf.SHT_NOBITS && int64(s.Offset + s.Size) > size {
+        return "is truncated (section " + s.Name + " extends beyond the end of the file)"
+      }
+    }
+  case magic[0] == 0xcf || magic[0] == 0xce || magic[3] == 0xcf || magic[3] == 0xce:
+    if _, err := macho.NewFile(fd); err != nil {
+      return "is corrupt (" + err.Error() + ")"
+    }
+  case magic[0] == 0x64 && magic[1] == 0x86, magic[0] == 0x4c && magic[1] == 0x01, magic[0] == 0x64 && magic[1] == 0xaa:
+    if _, err := pe.NewFile(fd); err != nil {
+      return "is corrupt (" + err.Error() + ")"
+    }
+  }
+
+  return ""
+}
+
+// sizes like 500M or 10G
+func ParseSize(str string) (int64, error) {
+  mult := int64(1)
+
+  switch strings.ToUpper(str[len(str)-1:]) {
+  case "K":
+    mult = 1 << 10
+  case "M":
+    mult = 1 << 20
+  case "G":
+    mult = 1 << 30
+  case "T":
+    mult = 1 << 40
+  }
+
+  if mult != 1 {
+    str = str[0:len(str)-1]
+  }
+
+  n, err := strconv.ParseInt(str, 10, 64)
+  if err != nil || n < 0 {
+    return 0, errors.New("invalid size " + str)
+  }
+
+  return n*mult, nil
+}
+
+func FormatSize(n int64) string {
+  units := []string{"B", "K", "M", "G", "T"}
+
+  f := float64(n)
+  i := 0
+  for f >= 1024 && i < len(units) - 1 {
+    f /= 1024
+    i++
+  }
+
+  if i == 0 {
+    return fmt.Sprintf("%d%s", n, units[i])
+  } else {
+    return fmt.Sprintf("%.1f%s", f, units[i])
+  }
+}
+
+// durations like 30d, or anything accepted by time.ParseDuration, the age of --max-age must be positive
+func ParseAge(str string) (time.Duration, error) {
+  var d time.Duration
+
+  if strings.HasSuffix(str, "d") {
+    n, err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+    if err != nil {
+      return 0, errors.New("invalid --max-age " + str)
+    }
+
+    d = time.Duration(n)*24*time.Hour
+  } else {
+    var err error
+    d, err = time.ParseDuration(str)
+    if err != nil {
+      return 0, errors.New("invalid --max-age " + str)
+    }
+  }
+
+  if d <= 0 {
+    return 0, errors.New("invalid --max-age " + str + " (must be positive)")
+  }
+
+  return d, nil
+}
+
+func CacheStats(entries []*CacheEntry) {
+  sizes := make(map[string]int64)
+  counts := make(map[string]int)
+
+  var total int64
+
+  for _, entry := range entries {
+    root := entry.Root
+    if root == "" {
+      root = "<unknown>"
+    }
+
+    sizes[root] += entry.Size
+    counts[root] += 1
+    total += entry.Size
+  }
+
+  roots := make([]string, 0)
+  for root := range sizes {
+    roots = append(roots, root)
+  }
+
+  sort.Strings(roots)
+
+  for _, root := range roots {
+    fmt.Printf("%8s %6d  %s\n", FormatSize(sizes[root]), counts[root], root)
+  }
+
+  fmt.Printf("%8s %6d  total\n", FormatSize(total), len(entries))
+}
+
+func removeCacheEntries(entries []*CacheEntry, reason string, dryRun bool) error {
+  for _, entry := range entries {
+    fmt.Printf("remove %s (%s, %s)\n", entry.Name(), reason, FormatSize(entry.Size))
+
+    if !dryRun {
+      if err := entry.Remove(); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// least recently used entries are removed first
+func CachePrune(entries []*CacheEntry, maxAge time.Duration, maxSize int64, orphans bool, dryRun bool) error {
+  remaining := make([]*CacheEntry, 0)
+
+  for _, entry := range entries {
+    if orphans && entry.Legacy {
+      if err := removeCacheEntries([]*CacheEntry{entry}, "left over from an older cache layout", dryRun); err != nil {
+        return err
+      }
+
+      continue
+    }
+
+    if orphans && entry.Source != "" {
+      if _, err := os.Stat(entry.Source); os.IsNotExist(err) {
+        if err := removeCacheEntries([]*CacheEntry{entry}, "source doesn't exist", dryRun); err != nil {
+          return err
+        }
+
+        continue
+      }
+    }
+
+    if maxAge > 0 && time.Since(entry.LastUsed) > maxAge {
+      if err := removeCacheEntries([]*CacheEntry{entry}, "unused since " + entry.LastUsed.Format("2006-01-02"), dryRun); err != nil {
+        return err
+      }
+
+      continue
+    }
+
+    remaining = append(remaining, entry)
+  }
+
+  if maxSize < 0 {
+    return nil
+  }
+
+  sort.Slice(remaining, func(i, j int) bool {
+    return remaining[i].LastUsed.After(remaining[j].LastUsed)
+  })
+
+  var total int64
+  for i, entry := range remaining {
+    total += entry.Size
+
+    if total > maxSize {
+      return removeCacheEntries(remaining[i:], "total size exceeds " + FormatSize(maxSize), dryRun)
+    }
+  }
+
+  return nil
+}
+
+func CacheVerify(cacheDir string, entries []*CacheEntry, fix bool, dryRun bool) error {
+  nCorrupt := 0
+
+  for _, entry := range entries {
+    problem := entry.Verify(cacheDir)
+    if problem == "" {
+      continue
+    }
+
+    nCorrupt += 1
+
+    if fix {
+      if err := removeCacheEntries([]*CacheEntry{entry}, problem, dryRun); err != nil {
+        return err
+      }
+    } else {
+      fmt.Printf("%s: %s\n", entry.Name(), problem)
+    }
+  }
+
+  if nCorrupt > 0 && !fix {
+    return errors.New(strconv.Itoa(nCorrupt) + " corrupt cache entries found (remove them with --fix)")
+  }
+
+  return nil
+}
+
+func CacheClear(entries []*CacheEntry, root string, dryRun bool) error {
+  if root != "" {
+    entries = filterCacheEntries(entries, func(entry *CacheEntry) bool {
+      return entry.BelongsTo(root)
+    })
+  }
+
+  return removeCacheEntries(entries, "clear", dryRun)
+}
+
+func filterCacheEntries(entries []*CacheEntry, fn func(entry *CacheEntry) bool) []*CacheEntry {
+  res := make([]*CacheEntry, 0)
+  for _, entry := range entries {
+    if fn(entry) {
+      res = append(res, entry)
+    }
+  }
+
+  return res
+}
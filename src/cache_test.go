@@ -0,0 +1,27 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestParseAge(t *testing.T) {
+  valid := map[string]time.Duration{
+    "30d": 30*24*time.Hour,
+    "1d":  24*time.Hour,
+    "12h": 12*time.Hour,
+    "90m": 90*time.Minute,
+  }
+
+  for str, want := range valid {
+    if got, err := ParseAge(str); err != nil || got != want {
+      t.Errorf("%s: expected %v, got %v (%v)", str, want, got, err)
+    }
+  }
+
+  for _, str := range []string{"0", "0d", "0s", "-1d", "-5h", "d", "x", ""} {
+    if _, err := ParseAge(str); err == nil {
+      t.Errorf("%q: expected an error", str)
+    }
+  }
+}
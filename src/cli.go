@@ -4,7 +4,9 @@ import (
   "errors"
   "os"
   "path/filepath"
+  "regexp"
   "sort"
+  "strconv"
   "strings"
 )
 
@@ -92,7 +94,7 @@ func ParseStringFlags(args []string, flagNames []string, result []*string) ([]st
 
     if strings.HasPrefix(arg, "-") {
       if j := FindString(flagNames, arg); j > -1 {
-        if i >= len(args) {
+        if i+1 >= len(args) {
           return nil, errors.New(arg + " expects an argument")
         }
 
@@ -111,6 +113,66 @@ func ParseStringFlags(args []string, flagNames []string, result []*string) ([]st
   return remaining, nil
 }
 
+// flags that can be repeated, the values are appended
+func ParseStringListFlags(args []string, flagNames []string, result []*[]string) ([]string, error) {
+  remaining  := make([]string, 0)
+
+  for i := 0; i < len(args); i++ {
+    arg := args[i]
+
+    if j := FindString(flagNames, arg); strings.HasPrefix(arg, "-") && j > -1 {
+      if i+1 >= len(args) {
+        return nil, errors.New(arg + " expects an argument")
+      }
+
+      *(result[j]) = append(*(result[j]), args[i+1])
+      i += 1
+    } else {
+      remaining = append(remaining, arg)
+    }
+  }
+
+  return remaining, nil
+}
+
+// `<flag>.<profile>` flags are only applied if profile is the active profile, flags of other profiles are dropped
+func ParseProfileFlags(args []string, profile string, flagNames []string, result []*string) ([]string, error) {
+  remaining := make([]string, 0)
+
+  for i := 0; i < len(args); i++ {
+    arg := args[i]
+
+    if j := strings.LastIndex(arg, "."); strings.HasPrefix(arg, "-") && j > 0 {
+      if k := FindString(flagNames, arg[0:j]); k > -1 {
+        if i+1 >= len(args) {
+          return nil, errors.New(arg + " expects an argument")
+        }
+
+        val := args[i+1]
+        i += 1
+
+        if arg[j+1:] == profile {
+          *(result[k]) = val
+        }
+
+        continue
+      }
+    }
+
+    remaining = append(remaining, arg)
+  }
+
+  return remaining, nil
+}
+
+func AssertValidProfile(profile string) error {
+  if !regexp.MustCompile(`^[A-Za-z0-9_-]*$`).MatchString(profile) {
+    return errors.New("invalid profile name " + profile)
+  }
+
+  return nil
+}
+
 func AssertNoArgs(args []string) error {
   if len(args) != 0 {
     return errors.New("unexpected arg " + args[0])
@@ -119,16 +181,25 @@ func AssertNoArgs(args []string) error {
   return nil
 }
 
-func ParseGeneralArgs(args []string, force *bool, dryRun *bool, dir *string) ([]string, error) {
-  args = ParseBoolFlags(args, []string{"-f", "-B", "-n"}, []*bool{force, force, dryRun})
+func ParseGeneralArgs(args []string, force *bool, dryRun *bool, keepGoing *bool, dir *string, jobs *int) ([]string, error) {
+  args = ParseBoolFlags(args, []string{"-f", "-B", "-n", "-k"}, []*bool{force, force, dryRun, keepGoing})
 
   var err error
 
-  args, err = ParseStringFlags(args, []string{"-C"}, []*string{dir})
+  jobsStr := ""
+
+  args, err = ParseStringFlags(args, []string{"-C", "-j"}, []*string{dir, &jobsStr})
   if err != nil {
     return nil, err
   }
 
+  if jobsStr != "" {
+    *jobs, err = strconv.Atoi(jobsStr)
+    if err != nil || *jobs < 1 {
+      return nil, errors.New("invalid -j " + jobsStr + " (expected a positive integer)")
+    }
+  }
+
   if *dir != "" {
     *dir, err = filepath.Abs(*dir)
     if err != nil {
@@ -139,8 +210,8 @@ func ParseGeneralArgs(args []string, force *bool, dryRun *bool, dir *string) ([]
   return args, nil
 }
 
-func ParseGeneralArgsFindMakefile(args []string, force *bool, dryRun *bool, dir *string) ([]string, error) {
-  rem, err := ParseGeneralArgs(args, force, dryRun, dir)
+func ParseGeneralArgsFindMakefile(args []string, force *bool, dryRun *bool, keepGoing *bool, dir *string, jobs *int) ([]string, error) {
+  rem, err := ParseGeneralArgs(args, force, dryRun, keepGoing, dir, jobs)
   if err != nil {
     return nil, err
   }
@@ -155,8 +226,8 @@ func ParseGeneralArgsFindMakefile(args []string, force *bool, dryRun *bool, dir
   return rem, nil
 }
 
-func ParseGeneralArgsDefaultDirPwd(args []string, force *bool, dryRun *bool, dir *string) ([]string, error) {
-  rem, err := ParseGeneralArgs(args, force, dryRun, dir)
+func ParseGeneralArgsDefaultDirPwd(args []string, force *bool, dryRun *bool, keepGoing *bool, dir *string, jobs *int) ([]string, error) {
+  rem, err := ParseGeneralArgs(args, force, dryRun, keepGoing, dir, jobs)
   if err != nil {
     return nil, err
   }
@@ -0,0 +1,61 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+)
+
+const (
+  COMPDB = "compile_commands.json"
+)
+
+// see https://clang.llvm.org/docs/JSONCompilationDatabase.html
+type CompDBEntry struct {
+  Directory string   `json:"directory"`
+  File      string   `json:"file"`
+  Arguments []string `json:"arguments"`
+  Output    string   `json:"output"`
+}
+
+// nothing is compiled, in dry-run mode the compilation database is printed instead of written
+func (p *CProject) WriteCompDB() error {
+  dir, err := os.Getwd()
+  if err != nil {
+    return err
+  }
+
+  entries := make([]CompDBEntry, 0)
+
+  for _, f := range p.FilterFiles(func(f *File) bool {
+    return p.IsCFile(f.Path)
+  }) {
+    cmdStr, err := p.objCommand(f)
+    if err != nil {
+      return err
+    }
+
+    cmdName, cmdArgs := SplitCommand(cmdStr)
+
+    entries = append(entries, CompDBEntry{
+      Directory: dir,
+      File:      f.Path,
+      Arguments: append([]string{cmdName}, cmdArgs...),
+      Output:    p.ObjPath(f),
+    })
+  }
+
+  b, err := json.MarshalIndent(entries, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  if p.dryRun {
+    fmt.Println(string(b))
+    return nil
+  }
+
+  return ioutil.WriteFile(filepath.Join(p.root, COMPDB), append(b, '\n'), 0644)
+}
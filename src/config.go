@@ -0,0 +1,177 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const (
+  CONFIG_TOML = "bake.toml"
+  CONFIG_JSON = "bake.json"
+)
+
+var (
+  CONFIG_FILES = []string{CONFIG_TOML, CONFIG_JSON}
+)
+
+// options that can be set per profile, empty options fall back to the base options
+type ConfigOptions struct {
+  Compiler   string   `json:"compiler"`
+  Linker     string   `json:"linker"`
+  LibLinker  string   `json:"lib-linker"`
+  Archiver   string   `json:"archiver"`
+  EmitPch    string   `json:"emit-pch"`
+  IncludePch string   `json:"include-pch"`
+  Dst        string   `json:"dst"`
+  Libs       []string `json:"libs"` // linked into every exe and shared lib, in addition to the libs detected from the includes
+  Include    []string `json:"include"` // source discovery globs, see WalkOptions
+  Exclude    []string `json:"exclude"`
+  FollowSymlinks bool `json:"follow-symlinks"`
+  ShareRoots     bool `json:"share-roots"` // always share objects of the store with other checkouts, even if they embed the root, see storeManifestKey
+
+  LibMap     map[string][]string `json:"lib-map"` // system include pattern -> libs and linker flags, see LibMap
+}
+
+// contents of bake.toml or bake.json in the project root, flags passed to `bake --project` override these
+type Config struct {
+  ConfigOptions
+
+  Project  string                   `json:"project"` // c (default) or go
+  Profiles map[string]ConfigOptions `json:"profiles"`
+}
+
+func FindConfigFile(dir string) (string, error) {
+  for _, name := range CONFIG_FILES {
+    path := filepath.Join(dir, name)
+
+    info, err := os.Stat(path)
+    if err == nil {
+      if info.IsDir() {
+        return "", errors.New(path + " is directory")
+      }
+
+      return path, nil
+    } else if !os.IsNotExist(err) {
+      return "", err
+    }
+  }
+
+  return "", nil
+}
+
+func ConfigExists(dir string) (bool, error) {
+  path, err := FindConfigFile(dir)
+  if err != nil {
+    return false, err
+  }
+
+  return path != "", nil
+}
+
+// returns an empty config if the dir doesn't contain a config file
+func ReadConfig(dir string) (*Config, error) {
+  cfg := &Config{}
+
+  path, err := FindConfigFile(dir)
+  if err != nil || path == "" {
+    return cfg, err
+  }
+
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  if filepath.Base(path) == CONFIG_TOML {
+    m, err := ParseToml(string(b), path)
+    if err != nil {
+      return nil, err
+    }
+
+    b, err = json.Marshal(m)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  dec := json.NewDecoder(bytes.NewReader(b))
+  dec.DisallowUnknownFields()
+
+  if err := dec.Decode(cfg); err != nil {
+    return nil, errors.New(path + ": " + err.Error())
+  }
+
+  if cfg.Project == "" {
+    cfg.Project = "c"
+  }
+
+  for name := range cfg.Profiles {
+    if err := AssertValidProfile(name); err != nil {
+      return nil, errors.New(path + ": " + err.Error())
+    }
+  }
+
+  return cfg, nil
+}
+
+// the options of the profile override the base options, libs and globs are combined
+func (c *Config) Options(profile string) (ConfigOptions, error) {
+  opts := c.ConfigOptions
+
+  if profile == "" {
+    return opts, nil
+  }
+
+  popts, ok := c.Profiles[profile]
+  if !ok {
+    if len(c.Profiles) == 0 {
+      return opts, nil
+    }
+
+    names := make([]string, 0)
+    for name := range c.Profiles {
+      names = append(names, name)
+    }
+
+    sort.Strings(names)
+
+    return opts, errors.New("profile " + profile + " not found in config (available: " + strings.Join(names, ", ") + ")")
+  }
+
+  override := func(dst *string, src string) {
+    if src != "" {
+      *dst = src
+    }
+  }
+
+  override(&opts.Compiler, popts.Compiler)
+  override(&opts.Linker, popts.Linker)
+  override(&opts.LibLinker, popts.LibLinker)
+  override(&opts.Archiver, popts.Archiver)
+  override(&opts.EmitPch, popts.EmitPch)
+  override(&opts.IncludePch, popts.IncludePch)
+  override(&opts.Dst, popts.Dst)
+
+  opts.Libs = append(append([]string{}, opts.Libs...), popts.Libs...)
+  opts.Include = append(append([]string{}, opts.Include...), popts.Include...)
+  opts.Exclude = append(append([]string{}, opts.Exclude...), popts.Exclude...)
+  opts.FollowSymlinks = opts.FollowSymlinks || popts.FollowSymlinks
+  opts.ShareRoots = opts.ShareRoots || popts.ShareRoots
+
+  libMap := make(map[string][]string)
+  for _, m := range []map[string][]string{opts.LibMap, popts.LibMap} {
+    for pattern, args := range m {
+      libMap[pattern] = args
+    }
+  }
+
+  opts.LibMap = libMap
+
+  return opts, nil
+}
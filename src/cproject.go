@@ -1,8 +1,9 @@
 package main
 
 import (
-  "encoding/base64"
   "errors"
+  "fmt"
+  "io/ioutil"
   "os"
   "path/filepath"
   "strings"
@@ -15,8 +16,10 @@ var (
   HCEXTS = append(HEXTS, CEXTS...)
 
   HEAD_PAT    = []byte("//!")
-  INCLUDE_PAT = []byte("#include ")
-  MAIN_PAT    = []byte("int main(")
+)
+
+const (
+  LINK_MANIFESTS_REL = ".bake"
 )
 
 type CProject struct {
@@ -25,6 +28,11 @@ type CProject struct {
   updatedObjs    []string // also pch can go here
   compilerCmd    string
   linkerCmd      string
+  libLinkerCmd   string
+  archiverCmd    string
+  remote         *RemoteStore // nil if not configured
+  libMap         *LibMap
+  pkgConfig      *PkgConfig
   emitPchCmd     string
   includePchOpts string
 }
@@ -39,13 +47,57 @@ func NewCProject(args []string) (Project, error) {
 
   p.updatedObjs = make([]string, 0)
 
-  rem, err = ParseStringFlags(rem, []string{"--compiler", "--linker", "--emit-pch", "--include-pch"}, []*string{
+  if err := os.MkdirAll(p.CacheDir(), 0755); err != nil {
+    return nil, err
+  }
+
+  p.libMap, err = LoadLibMap(p.config.LibMap)
+  if err != nil {
+    return nil, err
+  }
+
+  p.pkgConfig = NewPkgConfig()
+
+  p.compilerCmd = p.config.Compiler
+  p.linkerCmd = p.config.Linker
+  p.libLinkerCmd = p.config.LibLinker
+  p.archiverCmd = p.config.Archiver
+  p.emitPchCmd = p.config.EmitPch
+  p.includePchOpts = p.config.IncludePch
+
+  remoteURL := os.Getenv("BAKE_REMOTE_CACHE")
+
+  rem, err = ParseStringFlags(rem, []string{"--compiler", "--linker", "--lib-linker", "--archiver", "--emit-pch", "--include-pch", "--remote-cache"}, []*string{
+    &p.compilerCmd,
+    &p.linkerCmd,
+    &p.libLinkerCmd,
+    &p.archiverCmd,
+    &p.emitPchCmd,
+    &p.includePchOpts,
+    &remoteURL,
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  rem, err = ParseProfileFlags(rem, p.profile, []string{"--compiler", "--linker", "--lib-linker", "--archiver", "--emit-pch", "--include-pch"}, []*string{
     &p.compilerCmd,
     &p.linkerCmd,
+    &p.libLinkerCmd,
+    &p.archiverCmd,
     &p.emitPchCmd,
     &p.includePchOpts,
   })
 
+  if err != nil {
+    return nil, err
+  }
+
+  if remoteURL != "" {
+    p.remote = NewRemoteStore(remoteURL, os.Getenv("BAKE_REMOTE_CACHE_READONLY") != "")
+  }
+
   if p.compilerCmd == "" {
     return nil, errors.New("--compiler not specified")
   }
@@ -54,10 +106,6 @@ func NewCProject(args []string) (Project, error) {
     return nil, errors.New("--linker not specified")
   }
 
-  if err != nil {
-    return nil, err
-  }
-
   if err := AssertNoArgs(rem); err != nil {
     return nil, err
   }
@@ -96,8 +144,17 @@ func (p *CProject) IsCFile(path string) bool {
   return ContainsString(CEXTS, filepath.Ext(path))
 }
 
+// test files also have a main, but they aren't exes
 func (p *CProject) IsExeFile(f *File) bool {
-  return f.Main || strings.HasPrefix(f.Head, "exe")
+  return !p.IsTestFile(f) && (f.Main || strings.HasPrefix(f.Head, "exe"))
+}
+
+func (p *CProject) IsTestFile(f *File) bool {
+  return strings.HasPrefix(f.Head, "test")
+}
+
+func (p *CProject) IsLibFile(f *File) bool {
+  return strings.HasPrefix(f.Head, "lib")
 }
 
 func (p *CProject) IsPchFile(f *File) bool {
@@ -105,46 +162,12 @@ func (p *CProject) IsPchFile(f *File) bool {
 }
 
 func (p *CProject) ParseCFile(path string, modTime time.Time) (*File, error) {
-  r, err := NewRaw(path)
+  b, err := ioutil.ReadFile(path)
   if err != nil {
     return nil, err
   }
 
-  head := ""
-  rawDeps := make([]string, 0)
-  main := false
-
-  isMatch, eof := r.NextMatch(HEAD_PAT)
-  if isMatch && !eof {
-    head, eof = r.RestOfLine()
-  }
-
-  for !eof {
-    isMatch, eof = r.NextMatch(INCLUDE_PAT)
-    if isMatch {
-      var rawDep string
-      rawDep, eof = r.RestOfLine()
-
-      if rawDep[0] == '"' {
-        fs := strings.Split(rawDep[1:], "\"")
-        if len(fs) > 1 {
-          rawDep = fs[0]
-          rawDeps = append(rawDeps, rawDep)
-        }
-      } else if rawDep[0] == '<' {
-        fs := strings.Split(rawDep[1:], ">")
-        if len(fs) > 1 {
-          rawDep = fs[0]
-          rawDeps = append(rawDeps, "<" + rawDep + ">")
-        }
-      }
-    } else if isMatch, eof = r.NextMatch(MAIN_PAT); isMatch {
-      main = true
-      eof = r.NextLine()
-    } else {
-      eof = r.NextLine()
-    }
-  }
+  head, rawDeps, main := ScanCSource(b)
 
   if main {
     if !p.IsCFile(path) {
@@ -152,7 +175,11 @@ func (p *CProject) ParseCFile(path string, modTime time.Time) (*File, error) {
     }
   }
 
-  return NewFile(path, modTime, head, rawDeps, main), nil
+  f := NewFile(path, modTime, head, rawDeps, main)
+  f.Pkgs = ScanPkgHeads(b)
+  f.Public, f.PublicDir = ScanPublicHead(b)
+
+  return f, nil
 }
 
 func (p *CProject) ResolveDeps() error {
@@ -175,26 +202,62 @@ func (p *CProject) ResolveDeps() error {
   return nil
 }
 
+// hashed, so that deep source paths don't exceed the max file name length
 func (p *CProject) ObjPath(f *File) string {
-  return filepath.Join(CACHE_DIR, base64.URLEncoding.EncodeToString([]byte(f.Path)))
+  return filepath.Join(p.CacheDir(), HashBytes([]byte(f.Path)))
 }
 
 func (p *CProject) PchPath(f *File) string {
   return p.ObjPath(f) + ".pch"
 }
 
-func (p *CProject) ObjUpToDate(f *File) bool {
-  objPath := p.ObjPath(f)
+func (p *CProject) DepfilePath(f *File) string {
+  return p.ObjPath(f) + DEPFILE_EXT
+}
 
-  return f.DstUpToDate(objPath)
+// if the compiler emits depfiles, these are used instead of the scanned deps
+func (p *CProject) UsesDepfiles() bool {
+  return strings.Contains(p.compilerCmd, "{depfile}")
+}
+
+func (p *CProject) ObjOutdated(f *File) *Reason {
+  cmdStr, err := p.objCommand(f)
+  if err != nil {
+    return NewReason(REASON_ERROR, err.Error())
+  }
+
+  if p.UsesDepfiles() {
+    return RecordedContentOutdated(p.ObjPath(f), CommandSignature(cmdStr), p.dryRun, p.LookupFile)
+  } else {
+    return ContentOutdated(f, p.ObjPath(f), CommandSignature(cmdStr), p.dryRun)
+  }
+}
+
+// lib heads: `lib [static|shared] [<name>]`
+func (p *CProject) libHeadFields(f *File) []string {
+  fs := strings.Fields(f.Head)
+
+  if len(fs) > 1 && (fs[1] == "static" || fs[1] == "shared") {
+    return fs[2:]
+  } else if len(fs) > 0 {
+    return fs[1:]
+  }
+
+  return fs
+}
+
+func (p *CProject) IsStaticLibFile(f *File) bool {
+  fs := strings.Fields(f.Head)
+
+  return p.IsLibFile(f) && len(fs) > 1 && fs[1] == "static"
 }
 
 func (p *CProject) LibName(f *File) string {
-  if strings.HasPrefix(f.Head, "lib") {
-    fs := strings.Fields(f.Head)
+  if p.IsLibFile(f) {
+    fs := p.libHeadFields(f)
 
-    if len(fs) > 1 {
-      return fs[1]
+    if len(fs) > 0 {
+      return fs[0]
     }
   }
 
@@ -203,13 +266,27 @@ func (p *CProject) LibName(f *File) string {
 
 // TODO: should also work on windows
 func (p *CProject) LibPath(f *File) string {
-  base := p.LibName(f) + ".so"
+  var base string
+  if p.IsStaticLibFile(f) {
+    base = "lib" + p.LibName(f) + ".a"
+  } else {
+    base = p.LibName(f) + ".so"
+  }
 
   return filepath.Join(p.dstDir, base)
 }
 
+// tests are named after their file by default, as a dir can contain many tests
 func (p *CProject) ExeName(f *File) string {
-  if strings.HasPrefix(f.Head, "exe") {
+  if p.IsTestFile(f) {
+    fs := strings.Fields(f.Head)
+
+    if len(fs) > 1 {
+      return fs[1]
+    }
+
+    return strings.TrimSuffix(filepath.Base(f.Path), filepath.Ext(f.Path))
+  } else if strings.HasPrefix(f.Head, "exe") {
     fs := strings.Fields(f.Head)
 
     if len(fs) > 1 {
@@ -223,6 +300,10 @@ func (p *CProject) ExeName(f *File) string {
 func (p *CProject) ExePath(f *File) string {
   base := p.ExeName(f)
 
+  if p.IsTestFile(f) {
+    return filepath.Join(p.TestDir(), base)
+  }
+
   return filepath.Join(p.dstDir, base)
 }
 
@@ -248,8 +329,9 @@ func (p *CProject) ListExeObjFiles(f *File) []*File {
     return false
   }
 
+  // other tests are never linked in
   files := p.FilterFiles(func(f *File) bool {
-    return p.IsCFile(f.Path) && inDir(f.Path)
+    return p.IsCFile(f.Path) && !p.IsTestFile(f) && inDir(f.Path)
   })
 
   // include self of course
@@ -269,24 +351,157 @@ func (p *CProject) ListExeObjs(f *File) []string {
   return objPaths
 }
 
-func (p *CProject) ExeUpToDate(f *File) bool {
-  dst := p.ExePath(f)
+// objects of a lib: all non-exe cpp files in the directory of the lib file, and in the directories of its dependencies
+func (p *CProject) ListLibObjFiles(f *File) []*File {
+  dirs := []string{filepath.Dir(f.Path)}
+
+  for _, dep := range f.Deps {
+    dirs = append(dirs, filepath.Dir(dep.Path))
+  }
+
+  dirs = SortUnique(dirs)
+
+  files := p.FilterFiles(func(f *File) bool {
+    return p.IsCFile(f.Path) && !p.IsExeFile(f) && !p.IsTestFile(f) && ContainsString(dirs, filepath.Dir(f.Path))
+  })
+
+  return SortUniqueFiles(files)
+}
+
+func (p *CProject) ListLibObjs(f *File) []string {
+  fObjs := p.ListLibObjFiles(f)
+
+  objPaths := make([]string, len(fObjs))
+  for i, fObj := range fObjs {
+    objPaths[i] = p.ObjPath(fObj)
+  }
+
+  return objPaths
+}
+
+func (p *CProject) ExeOutdated(f *File) *Reason {
+  cmdStr, err := p.exeCommand(f)
+  if err != nil {
+    return NewReason(REASON_ERROR, err.Error())
+  }
+
+  return p.linkedOutdated(p.ExePath(f), cmdStr, p.ListExeObjFiles(f))
+}
+
+func (p *CProject) LibOutdated(f *File) *Reason {
+  cmdStr, err := p.libCommand(f)
+  if err != nil {
+    return NewReason(REASON_ERROR, err.Error())
+  }
+
+  return p.linkedOutdated(p.LibPath(f), cmdStr, p.ListLibObjFiles(f))
+}
 
-  objs := p.ListExeObjs(f)
+// the manifests of linked dsts record the command and the content hashes of the objects (keyed by their sources),
+// they are kept in a hidden dir of dst
+func (p *CProject) LinkManifestDst(dst string) string {
+  rel, err := filepath.Rel(p.dstDir, dst)
+  if err != nil {
+    rel = filepath.Base(dst)
+  }
 
-  isUpToDate := true
+  return filepath.Join(p.dstDir, LINK_MANIFESTS_REL, rel)
+}
+
+// linked dsts are outdated if any of their objects is being recompiled, if the command changed (e.g. the libs), or if
+// any of their objects differs from the one that was linked (e.g. recompiled by `bake run` or `bake --test` for another target)
+func (p *CProject) linkedOutdated(dst string, cmdStr string, objFiles []*File) *Reason {
   if _, err := os.Stat(dst); err != nil {
-    isUpToDate = false
-  } else {
-    for _, obj := range objs {
-      if p.IsUpdatedObj(obj) {
-        isUpToDate = false
-        break
+    return NewReason(REASON_MISSING, "")
+  }
+
+  for _, fObj := range objFiles {
+    if p.IsUpdatedObj(p.ObjPath(fObj)) {
+      return NewReason(REASON_RECOMPILED, fObj.Path)
+    }
+  }
+
+  m, err := ReadManifest(p.LinkManifestDst(dst))
+  if err != nil {
+    return NewReason(REASON_MANIFEST, "")
+  }
+
+  if m.Signature != CommandSignature(cmdStr) {
+    return NewReason(REASON_COMMAND, "")
+  }
+
+  for _, fObj := range objFiles {
+    entry, ok := m.Entries[fObj.Path]
+    if !ok {
+      return NewReason(REASON_ADDED, fObj.Path)
+    }
+
+    stat, err := os.Stat(p.ObjPath(fObj))
+    if err != nil {
+      return NewReason(REASON_RECOMPILED, fObj.Path)
+    }
+
+    if stat.ModTime().Equal(entry.ModTime) {
+      continue
+    }
+
+    b, err := ioutil.ReadFile(p.ObjPath(fObj))
+    if err != nil || HashBytes(b) != entry.Hash {
+      return NewReason(REASON_RECOMPILED, fObj.Path)
+    }
+  }
+
+  if len(objFiles) != len(m.Entries) {
+    for path := range m.Entries {
+      if len(FilterFiles(objFiles, func(f *File) bool { return f.Path == path })) == 0 {
+        return NewReason(REASON_REMOVED, path)
       }
     }
   }
 
-  return isUpToDate
+  return nil
+}
+
+func (p *CProject) newLinkManifest(dst string, cmdStr string, objFiles []*File) (*Manifest, error) {
+  m := &Manifest{p.root, dst, CommandSignature(cmdStr), make(map[string]ManifestEntry)}
+
+  for _, fObj := range objFiles {
+    obj := p.ObjPath(fObj)
+
+    stat, err := os.Stat(obj)
+    if err != nil {
+      return nil, err
+    }
+
+    b, err := ioutil.ReadFile(obj)
+    if err != nil {
+      return nil, err
+    }
+
+    m.Entries[fObj.Path] = ManifestEntry{HashBytes(b), stat.ModTime()}
+  }
+
+  return m, nil
+}
+
+// the manifest is only written if the command succeeds
+func (p *CProject) runLinkCommand(dst string, cmdStr string, objFiles []*File) error {
+  if err := RemoveManifest(p.LinkManifestDst(dst)); err != nil {
+    return err
+  }
+
+  cmdName, cmdArgs := SplitCommand(cmdStr)
+
+  if err := RunCommand(cmdName, cmdArgs); err != nil {
+    return p.CommandError(cmdName, cmdArgs, err)
+  }
+
+  m, err := p.newLinkManifest(dst, cmdStr, objFiles)
+  if err != nil {
+    return err
+  }
+
+  return m.Write(p.LinkManifestDst(dst))
 }
 
 func (p *CProject) getPchFile() (*File, error) {
@@ -320,39 +535,65 @@ func (p *CProject) HasPchFile() (bool, error) {
   }
 }
 
-func (p *CProject) includeDirOpts(f *File) string {
+// the value of the {include} placeholder: include dirs, and the cflags of the pkg-config packages
+func (p *CProject) includeDirOpts(f *File) (string, error) {
   includeDirs := p.ListIncludeDirs(f)
 
-  if len(includeDirs) == 0 {
-    return ""
-  } else {
-    return "-I " + strings.Join(includeDirs, "-I ")
+  opts := ""
+  if len(includeDirs) > 0 {
+    opts = "-I " + strings.Join(includeDirs, " -I ")
+  }
+
+  cflags, err := p.pkgConfig.Query("--cflags", p.ListObjPkgs(f))
+  if err != nil {
+    return "", err
   }
+
+  return strings.TrimSpace(opts + " " + cflags), nil
 }
 
-func (p *CProject) buildPch() error {
-  f, err := p.getPchFile()
+func (p *CProject) pchCommand(f *File) (string, error) {
+  includeOpts, err := p.includeDirOpts(f)
   if err != nil {
-    return err
+    return "", err
   }
 
-  if f == nil {
-    return nil
+  templateArgs := map[string]string{
+    "include": includeOpts,
+    "header": f.Path,
+    "output": p.PchPath(f),
   }
 
-  pchPath := p.PchPath(f)
+  return FillTemplate(p.emitPchCmd, templateArgs, "--emit-pch")
+}
 
-  if f.DstUpToDate(pchPath) && !p.force {
-    return nil
+func (p *CProject) PchOutdated(f *File) *Reason {
+  cmdStr, err := p.pchCommand(f)
+  if err != nil {
+    return NewReason(REASON_ERROR, err.Error())
   }
 
-  templateArgs := map[string]string{
-    "include": p.includeDirOpts(f),
-    "header": f.Path,
-    "output": pchPath,
+  return ContentOutdated(f, p.PchPath(f), CommandSignature(cmdStr), p.dryRun)
+}
+
+// returns a nil job if the pch doesn't need to be built
+func (p *CProject) schedulePch(s *Scheduler) (*Job, error) {
+  f, err := p.getPchFile()
+  if err != nil {
+    return nil, err
+  }
+
+  if f == nil || !p.NeedsRebuild("pch", f.Path, func() *Reason { return p.PchOutdated(f) }) {
+    return nil, nil
   }
 
-  cmdStr, err := FillTemplate(p.emitPchCmd, templateArgs, "--emit-pch")
+  return s.Add(func() error {
+    return p.buildPch(f)
+  }), nil
+}
+
+func (p *CProject) buildPch(f *File) error {
+  cmdStr, err := p.pchCommand(f)
   if err != nil {
     return err
   }
@@ -362,68 +603,201 @@ func (p *CProject) buildPch() error {
   p.PrintCommand(cmdName, cmdArgs)
 
   if !p.dryRun {
-    return RunCommand(cmdName, cmdArgs)
+    return p.runCachedCommand(f, p.PchPath(f), cmdStr, "")
   } else {
     return nil
   }
 }
 
+// the manifest is only written if the command succeeds
+// if depfile isn't empty the manifest is created using the deps listed in it
+func (p *CProject) runCachedCommand(f *File, dst string, cmdStr string, depfile string) error {
+  if err := RemoveManifest(dst); err != nil {
+    return err
+  }
+
+  // dst might be a hard link into the object store, which must not be overwritten
+  if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  if depfile != "" {
+    if err := os.Remove(depfile); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+
+  // files edited during the compilation are thus recorded with their old hash, and rebuilt next time
+  if err := HashFiles(f.ListDeepDeps()); err != nil {
+    return err
+  }
+
+  cmdName, cmdArgs := SplitCommand(cmdStr)
+
+  if err := RunCommand(cmdName, cmdArgs); err != nil {
+    return p.CommandError(cmdName, cmdArgs, err)
+  }
+
+  if depfile == "" {
+    return WriteContentManifest(f, dst, p.root, CommandSignature(cmdStr))
+  }
+
+  depPaths, err := ParseDepfile(depfile)
+  if err != nil {
+    return err
+  }
+
+  deps := []*File{f}
+  for _, depPath := range depPaths {
+    dep, err := p.LookupFile(depPath)
+    if err != nil {
+      return err
+    }
+
+    deps = append(deps, dep)
+  }
+
+  return WriteRecordedManifest(dst, p.root, f.Path, CommandSignature(cmdStr), SortUniqueFiles(deps))
+}
+
+// objects are marked as updated before they are actually compiled, so that dependent libs and exes can be scheduled
+func (p *CProject) scheduleObjs(s *Scheduler, cppFiles []*File, pchJob *Job) map[*File]*Job {
+  objJobs := make(map[*File]*Job)
+
+  for _, f := range cppFiles {
+    f := f
+
+    p.mutex.Lock()
+
+    p.updatedObjs = append(p.updatedObjs, p.ObjPath(f))
+
+    p.mutex.Unlock()
+
+    objJobs[f] = s.Add(func() error {
+      return p.CompileObj(f)
+    }, pchJob)
+  }
+
+  return objJobs
+}
+
+func listObjJobs(objJobs map[*File]*Job, objFiles []*File) []*Job {
+  jobs := make([]*Job, 0)
+
+  for _, f := range objFiles {
+    if j, ok := objJobs[f]; ok {
+      jobs = append(jobs, j)
+    }
+  }
+
+  return jobs
+}
+
+func (p *CProject) scheduleLib(s *Scheduler, f *File, objJobs map[*File]*Job) {
+  s.Add(func() error {
+    return p.CompileLib(f)
+  }, listObjJobs(objJobs, p.ListLibObjFiles(f))...)
+}
+
+func (p *CProject) scheduleExe(s *Scheduler, f *File, objJobs map[*File]*Job) {
+  s.Add(func() error {
+    return p.CompileExe(f)
+  }, listObjJobs(objJobs, p.ListExeObjFiles(f))...)
+}
+
 func (p *CProject) Build() error {
-  if err := p.buildPch(); err != nil {
+  s := p.NewScheduler()
+
+  pchJob, err := p.schedulePch(s)
+  if err != nil {
     return err
   }
 
   cppFiles := p.FilterFiles(func(f *File) bool {
-    return p.IsCFile(f.Path) && (p.force || !p.ObjUpToDate(f))
+    return p.IsCFile(f.Path) && p.NeedsRebuild("obj", f.Path, func() *Reason { return p.ObjOutdated(f) })
   })
 
-  if err := RunPar(len(cppFiles), func(i int) error {
-    return p.CompileObj(cppFiles[i])
-  }); err != nil {
-    return err
+  objJobs := p.scheduleObjs(s, cppFiles, pchJob)
+
+  libFiles := p.FilterFiles(func(f *File) bool {
+    return p.IsLibFile(f) && p.NeedsRebuild("lib", p.LibPath(f), func() *Reason { return p.LibOutdated(f) })
+  })
+
+  for _, f := range libFiles {
+    p.scheduleLib(s, f, objJobs)
   }
 
   exeFiles := p.FilterFiles(func(f *File) bool {
-    return p.IsExeFile(f) && (p.force || !p.ExeUpToDate(f))
+    return p.IsExeFile(f) && p.NeedsRebuild("exe", p.ExePath(f), func() *Reason { return p.ExeOutdated(f) })
   })
 
-  return RunPar(len(exeFiles), func(i int) error {
-    return p.CompileExe(exeFiles[i])
-  })
+  for _, f := range exeFiles {
+    p.scheduleExe(s, f, objJobs)
+  }
+
+  return s.Run()
 }
 
 func (p *CProject) BuildTarget(target string) error {
-  if err := p.buildPch(); err != nil {
-    return err
-  }
-
   exeFiles := p.FilterFiles(func(f *File) bool {
-    return p.IsExeFile(f) && (p.ExeName(f) == target)
+    return (p.IsExeFile(f) || p.IsTestFile(f)) && (p.ExeName(f) == target)
   })
 
-  if len(exeFiles) == 0 {
+  libFiles := p.FilterFiles(func(f *File) bool {
+    return p.IsLibFile(f) && (p.LibName(f) == target)
+  })
+
+  if len(exeFiles) + len(libFiles) == 0 {
     return errors.New("bake target " + target + " not found")
-  } else if len(exeFiles) > 1 {
+  } else if len(exeFiles) + len(libFiles) > 1 {
     return errors.New("bake target " + target + " ambiguous")
   } 
 
-  // TODO: compile libs
+  s := p.NewScheduler()
 
-  exeFile := exeFiles[0]
+  pchJob, err := p.schedulePch(s)
+  if err != nil {
+    return err
+  }
 
-  cppFiles := p.ListExeObjFiles(exeFile)
+  var cppFiles []*File
+  if len(libFiles) == 1 {
+    cppFiles = p.ListLibObjFiles(libFiles[0])
+  } else {
+    cppFiles = p.ListExeObjFiles(exeFiles[0])
+  }
 
   cppFiles = FilterFiles(cppFiles, func(f *File) bool {
-    return p.force || !p.ObjUpToDate(f)
+    return p.NeedsRebuild("obj", f.Path, func() *Reason { return p.ObjOutdated(f) })
   })
 
-  if err := RunPar(len(cppFiles), func(i int) error {
-    return p.CompileObj(cppFiles[i])
-  }); err != nil {
-    return err
+  objJobs := p.scheduleObjs(s, cppFiles, pchJob)
+
+  // up-to-date checks come after scheduling the objs, so that updated objs are taken into account
+  if len(libFiles) == 1 {
+    if f := libFiles[0]; p.NeedsRebuild("lib", p.LibPath(f), func() *Reason { return p.LibOutdated(f) }) {
+      p.scheduleLib(s, libFiles[0], objJobs)
+    }
+  } else {
+    if f := exeFiles[0]; p.NeedsRebuild("exe", p.ExePath(f), func() *Reason { return p.ExeOutdated(f) }) {
+      p.scheduleExe(s, exeFiles[0], objJobs)
+    }
   }
 
-  return p.CompileExe(exeFile)
+  return s.Run()
+}
+
+// libs can't be run
+func (p *CProject) TargetExePath(target string) (string, error) {
+  exeFiles := p.FilterFiles(func(f *File) bool {
+    return (p.IsExeFile(f) || p.IsTestFile(f)) && (p.ExeName(f) == target)
+  })
+
+  if len(exeFiles) != 1 {
+    return "", errors.New("bake target " + target + " isn't an exe, or is ambiguous")
+  }
+
+  return p.ExePath(exeFiles[0]), nil
 }
 
 func (p *CProject) ListIncludeDirs(f *File) []string {
@@ -481,93 +855,191 @@ func (p *CProject) IncludePchOpts(cmdStr string) (string, error) {
   return cmdStr, nil
 }
 
-func (p *CProject) CompileObj(f *File) error {
-  objPath := p.ObjPath(f)
+func (p *CProject) objCommand(f *File) (string, error) {
+  includeOpts, err := p.includeDirOpts(f)
+  if err != nil {
+    return "", err
+  }
 
   templateArgs := map[string]string{
-    "include": p.includeDirOpts(f),
+    "include": includeOpts,
     "source": f.Path,
-    "output": objPath,
+    "output": p.ObjPath(f),
   }
 
+  if p.UsesDepfiles() {
+    templateArgs["depfile"] = p.DepfilePath(f)
+  }
 
   cmdStr, err := FillTemplate(p.compilerCmd, templateArgs, "--compiler")
   if err != nil {
-    return err
+    return "", err
   }
 
-  cmdStr, err = p.IncludePchOpts(cmdStr)
+  return p.IncludePchOpts(cmdStr)
+}
+
+func (p *CProject) CompileObj(f *File) error {
+  objPath := p.ObjPath(f)
+
+  cmdStr, err := p.objCommand(f)
   if err != nil {
     return err
   }
 
-  p.mutex.Lock()
-
-  p.updatedObjs = append(p.updatedObjs, objPath)
-
-  p.mutex.Unlock()
+  if !p.dryRun {
+    if hit, err := p.FetchObjFromStore(f, cmdStr); err != nil {
+      return err
+    } else if hit {
+      fmt.Println("<store> " + p.FormatPath(f.Path))
+      return nil
+    }
+  }
 
   cmdName, cmdArgs := SplitCommand(cmdStr)
 
   p.PrintCommand(cmdName, cmdArgs)
 
+  depfile := ""
+  if p.UsesDepfiles() {
+    depfile = p.DepfilePath(f)
+  }
+
   if !p.dryRun {
-    return RunCommand(cmdName, cmdArgs)
-  } else {
-    return nil
+    if err := p.runCachedCommand(f, objPath, cmdStr, depfile); err != nil {
+      return err
+    }
+
+    // failing to share the object isn't fatal
+    p.PutObjInStore(f, cmdStr)
   }
+
+  return nil
 }
 
-func (p *CProject) ListExeLibs(f *File) ([]string, error) {
-  deps_ := f.ListDeepRawDeps()
+// returns the libs and the extra linker flags
+func (p *CProject) ListExeLibs(f *File) ([]string, []string) {
+  return p.listSystemLibs(f.ListDeepRawDeps())
+}
+
+func (p *CProject) ListLibLibs(f *File) ([]string, []string) {
+  deps := f.ListDeepRawDeps()
+
+  for _, fObj := range p.ListLibObjFiles(f) {
+    deps = append(deps, fObj.ListDeepRawDeps()...)
+  }
+
+  return p.listSystemLibs(SortUnique(deps))
+}
+
+// the system includes are mapped to libs via the lib map, the libs of the config are always added
+func (p *CProject) listSystemLibs(deps []string) ([]string, []string) {
+  libs, flags, _ := p.libMap.Resolve(deps)
 
-  // filter the system files out
-  deps := make([]string, 0)
-  for _, dep := range deps_ {
-    if len(dep) > 2 && dep[0] == '<' && dep[len(dep)-1] == '>' {
-      deps = append(deps, dep)
+  for _, lib := range p.config.Libs {
+    if !ContainsString(libs, lib) {
+      libs = append(libs, lib)
     }
   }
 
-  res := make([]string, 0)
+  return libs, flags
+}
 
-  if ContainsAnyString(deps, []string{"<math>", "<cmath>"}) {
-    res = append(res, "m")
+func formatLibOpts(libs []string, flags []string) string {
+  opts := make([]string, 0)
+
+  for _, lib := range libs {
+    opts = append(opts, "-l" + lib)
   }
 
-  if ContainsString(deps, "OpenCL/cl2") {
-    res = append(res, "OpenCL")
+  return strings.Join(append(opts, flags...), " ")
+}
+
+func (p *CProject) exeCommand(f *File) (string, error) {
+  libs, flags := p.ListExeLibs(f)
+
+  libOpts, err := p.linkLibOpts(libs, flags, p.ListExeObjFiles(f))
+  if err != nil {
+    return "", err
   }
 
-  if ContainsAnyString(deps, []string{"<iostream>", "<string>", "<concepts>", "<utility>", "<map>", "<vector>", "<type_traits>", "<memory>", "<sstream>"}) {
-    res = append(res, "stdc++")
+  templateArgs := map[string]string{
+    "objects": strings.Join(p.ListExeObjs(f), " "),
+    "output": p.ExePath(f),
+    "libs": libOpts,
   }
 
-  return res, nil
+  return FillTemplate(p.linkerCmd, templateArgs, "--linker")
 }
 
 func (p *CProject) CompileExe(f *File) error {
   dst := p.ExePath(f)
 
-  objs := p.ListExeObjs(f)
-
-  libs, err := p.ListExeLibs(f)
+  cmdStr, err := p.exeCommand(f)
   if err != nil {
     return err
   }
 
-  libOpts := ""
-  if len(libs) > 0 {
-    libOpts = "-l" + strings.Join(libs, " -l")
+  cmdName, cmdArgs := SplitCommand(cmdStr)
+
+  p.PrintCommand(cmdName, cmdArgs)
+
+  if !p.dryRun {
+    // tests are linked into a subdir of dst
+    if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+      return err
+    }
+
+    return p.runLinkCommand(dst, cmdStr, p.ListExeObjFiles(f))
+  } else {
+    return nil
+  }
+}
+
+// static libs are archived
+func (p *CProject) libCommand(f *File) (string, error) {
+  objs := p.ListLibObjs(f)
+  if len(objs) == 0 {
+    return "", errors.New("lib " + p.LibName(f) + " doesn't have any objects")
+  }
+
+  if p.IsStaticLibFile(f) {
+    if p.archiverCmd == "" {
+      return "", errors.New("--archiver not specified (required for static lib " + p.LibName(f) + ")")
+    }
+
+    templateArgs := map[string]string{
+      "objects": strings.Join(objs, " "),
+      "output": p.LibPath(f),
+    }
+
+    return FillTemplate(p.archiverCmd, templateArgs, "--archiver")
+  }
+
+  if p.libLinkerCmd == "" {
+    return "", errors.New("--lib-linker not specified (required for lib " + p.LibName(f) + ")")
+  }
+
+  libs, flags := p.ListLibLibs(f)
+
+  libOpts, err := p.linkLibOpts(libs, flags, p.ListLibObjFiles(f))
+  if err != nil {
+    return "", err
   }
 
   templateArgs := map[string]string{
     "objects": strings.Join(objs, " "),
-    "output": dst,
+    "output": p.LibPath(f),
     "libs": libOpts,
   }
 
-  cmdStr, err := FillTemplate(p.linkerCmd, templateArgs, "--linker")
+  return FillTemplate(p.libLinkerCmd, templateArgs, "--lib-linker")
+}
+
+func (p *CProject) CompileLib(f *File) error {
+  dst := p.LibPath(f)
+
+  cmdStr, err := p.libCommand(f)
   if err != nil {
     return err
   }
@@ -577,12 +1049,15 @@ func (p *CProject) CompileExe(f *File) error {
   p.PrintCommand(cmdName, cmdArgs)
 
   if !p.dryRun {
-    return RunCommand(cmdName, cmdArgs)
+    // ar appends to existing archives, so stale members must be removed first
+    if p.IsStaticLibFile(f) {
+      if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+        return err
+      }
+    }
+
+    return p.runLinkCommand(dst, cmdStr, p.ListLibObjFiles(f))
   } else {
     return nil
   }
 }
-
-func (p *CProject) CompileLib(f *File) error {
-  panic("not yet implemented")
-}
@@ -0,0 +1,537 @@
+package main
+
+import (
+  "bytes"
+  "strconv"
+  "strings"
+)
+
+// The scanner is a small subset of a C preprocessor: it tokenizes the source (skipping comments and literals),
+// collects the #include directives and detects the main function.
+// Conditionals are only evaluated if their outcome is certain (e.g. `#if 0`, or `#ifdef` of a macro that is
+// defined in the same file), otherwise both branches are scanned, because missing a dependency is worse than
+// having a superfluous one.
+
+type cTokenKind int
+
+const (
+  C_IDENT cTokenKind = iota
+  C_NUMBER
+  C_STRING
+  C_CHAR
+  C_HEADER // <...> after #include
+  C_PUNCT
+)
+
+type cToken struct {
+  kind cTokenKind
+  text string
+}
+
+type tristate int
+
+const (
+  UNKNOWN tristate = iota
+  FALSE
+  TRUE
+)
+
+func (t tristate) Not() tristate {
+  switch t {
+  case TRUE:
+    return FALSE
+  case FALSE:
+    return TRUE
+  default:
+    return UNKNOWN
+  }
+}
+
+func (t tristate) Or(other tristate) tristate {
+  if t == TRUE || other == TRUE {
+    return TRUE
+  } else if t == FALSE && other == FALSE {
+    return FALSE
+  } else {
+    return UNKNOWN
+  }
+}
+
+type cCondFrame struct {
+  parent tristate // TRUE if all enclosing branches are certainly taken
+  cond   tristate // current branch
+  taken  tristate // any of the previous branches
+}
+
+type CScanner struct {
+  b []byte
+  i int
+
+  conds   []cCondFrame
+  defines map[string]tristate
+
+  prev    []cToken // last two tokens outside directives, for main detection
+
+  RawDeps []string
+  Main    bool
+}
+
+var (
+  BOM = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// returns the content of the `//!` head line (if any), and the rest of the preprocessed source
+func SplitCHead(b []byte) (string, []byte) {
+  b = bytes.TrimPrefix(b, BOM)
+  b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+
+  if !bytes.HasPrefix(b, HEAD_PAT) {
+    return "", b
+  }
+
+  line := b
+  rest := []byte{}
+  if i := bytes.IndexByte(b, '\n'); i > -1 {
+    line = b[0:i]
+    rest = b[i:]
+  }
+
+  return strings.TrimSpace(string(line[len(HEAD_PAT):])), rest
+}
+
+func NewCScanner(b []byte) *CScanner {
+  // line splicing
+  b = bytes.ReplaceAll(b, []byte("\\\n"), []byte{})
+
+  return &CScanner{
+    b:       b,
+    i:       0,
+    conds:   make([]cCondFrame, 0),
+    defines: make(map[string]tristate),
+    prev:    make([]cToken, 0),
+    RawDeps: make([]string, 0),
+    Main:    false,
+  }
+}
+
+func ScanCSource(b []byte) (string, []string, bool) {
+  head, rest := SplitCHead(b)
+
+  s := NewCScanner(rest)
+
+  s.Scan()
+
+  return head, s.RawDeps, s.Main
+}
+
+func (s *CScanner) Scan() {
+  line := make([]cToken, 0)
+
+  for {
+    tok, newline, eof := s.nextToken(line)
+
+    if newline || eof {
+      s.processLine(line)
+      line = line[:0]
+    }
+
+    if eof {
+      break
+    } else if !newline {
+      line = append(line, tok)
+    }
+  }
+}
+
+func isIdentStart(c byte) bool {
+  return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+  return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+  return c >= '0' && c <= '9'
+}
+
+func (s *CScanner) peek(offset int) byte {
+  if s.i+offset < len(s.b) {
+    return s.b[s.i+offset]
+  }
+
+  return 0
+}
+
+// line contains the tokens of the current line so far, which is needed to recognize header names
+func (s *CScanner) nextToken(line []cToken) (cToken, bool, bool) {
+  for s.i < len(s.b) {
+    c := s.b[s.i]
+
+    switch {
+    case c == '\n':
+      s.i++
+      return cToken{}, true, false
+    case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+      s.i++
+    case c == '/' && s.peek(1) == '/':
+      for s.i < len(s.b) && s.b[s.i] != '\n' {
+        s.i++
+      }
+    case c == '/' && s.peek(1) == '*':
+      // newlines inside block comments don't end the line
+      end := bytes.Index(s.b[s.i+2:], []byte("*/"))
+      if end == -1 {
+        s.i = len(s.b)
+      } else {
+        s.i += 2 + end + 2
+      }
+    case c == '<' && isIncludeLine(line):
+      end := bytes.IndexAny(s.b[s.i:], ">\n")
+      if end == -1 || s.b[s.i+end] != '>' {
+        // malformed, ignore the rest of the line
+        s.skipLine()
+        continue
+      }
+
+      tok := cToken{C_HEADER, string(s.b[s.i+1 : s.i+end])}
+      s.i += end + 1
+      return tok, false, false
+    case c == '"':
+      return s.lexQuoted('"', C_STRING), false, false
+    case c == '\'':
+      return s.lexQuoted('\'', C_CHAR), false, false
+    case isDigit(c) || (c == '.' && isDigit(s.peek(1))):
+      return s.lexNumber(), false, false
+    case isIdentStart(c):
+      return s.lexIdentOrPrefixedLiteral(), false, false
+    default:
+      for _, punct := range []string{"->", "::", "##"} {
+        if bytes.HasPrefix(s.b[s.i:], []byte(punct)) {
+          s.i += len(punct)
+          return cToken{C_PUNCT, punct}, false, false
+        }
+      }
+
+      s.i++
+      return cToken{C_PUNCT, string(c)}, false, false
+    }
+  }
+
+  return cToken{}, false, true
+}
+
+func isIncludeLine(line []cToken) bool {
+  if len(line) != 2 || line[0].text != "#" {
+    return false
+  }
+
+  switch line[1].text {
+  case "include", "include_next", "import":
+    return true
+  default:
+    return false
+  }
+}
+
+func (s *CScanner) skipLine() {
+  for s.i < len(s.b) && s.b[s.i] != '\n' {
+    s.i++
+  }
+}
+
+// unterminated literals end at the end of the line
+func (s *CScanner) lexQuoted(q byte, kind cTokenKind) cToken {
+  start := s.i
+  s.i++
+
+  for s.i < len(s.b) {
+    c := s.b[s.i]
+
+    if c == '\\' {
+      s.i += 2
+    } else if c == q {
+      s.i++
+      break
+    } else if c == '\n' {
+      break
+    } else {
+      s.i++
+    }
+  }
+
+  if s.i > len(s.b) {
+    s.i = len(s.b)
+  }
+
+  return cToken{kind, string(s.b[start:s.i])}
+}
+
+// pp-number, which also covers digit separators (1'000) and exponents (1e+3)
+func (s *CScanner) lexNumber() cToken {
+  start := s.i
+  s.i++
+
+  for s.i < len(s.b) {
+    c := s.b[s.i]
+
+    if (c == '+' || c == '-') && strings.ContainsRune("eEpP", rune(s.b[s.i-1])) {
+      s.i++
+    } else if c == '\'' && isIdentChar(s.peek(1)) {
+      s.i++
+    } else if isIdentChar(c) || c == '.' {
+      s.i++
+    } else {
+      break
+    }
+  }
+
+  return cToken{C_NUMBER, string(s.b[start:s.i])}
+}
+
+func (s *CScanner) lexIdentOrPrefixedLiteral() cToken {
+  start := s.i
+
+  for s.i < len(s.b) && isIdentChar(s.b[s.i]) {
+    s.i++
+  }
+
+  ident := string(s.b[start:s.i])
+
+  switch ident {
+  case "L", "u", "U", "u8":
+    if s.peek(0) == '"' {
+      tok := s.lexQuoted('"', C_STRING)
+      return cToken{C_STRING, ident + tok.text}
+    } else if s.peek(0) == '\'' {
+      tok := s.lexQuoted('\'', C_CHAR)
+      return cToken{C_CHAR, ident + tok.text}
+    }
+  case "R", "LR", "uR", "UR", "u8R":
+    if s.peek(0) == '"' {
+      return s.lexRawString(start)
+    }
+  }
+
+  return cToken{C_IDENT, ident}
+}
+
+// R"delim( ... )delim"
+func (s *CScanner) lexRawString(start int) cToken {
+  open := bytes.IndexByte(s.b[s.i:], '(')
+  if open == -1 {
+    s.i = len(s.b)
+    return cToken{C_STRING, string(s.b[start:])}
+  }
+
+  delim := s.b[s.i+1 : s.i+open]
+  terminator := append(append([]byte(")"), delim...), '"')
+
+  end := bytes.Index(s.b[s.i+open:], terminator)
+  if end == -1 {
+    s.i = len(s.b)
+  } else {
+    s.i += open + end + len(terminator)
+  }
+
+  return cToken{C_STRING, string(s.b[start:s.i])}
+}
+
+// TRUE if all enclosing conditional branches are certainly taken, FALSE if any of them is certainly not taken
+func (s *CScanner) active() tristate {
+  if len(s.conds) == 0 {
+    return TRUE
+  }
+
+  top := s.conds[len(s.conds)-1]
+
+  if top.parent == FALSE || top.cond == FALSE {
+    return FALSE
+  } else if top.parent == TRUE && top.cond == TRUE {
+    return TRUE
+  } else {
+    return UNKNOWN
+  }
+}
+
+func (s *CScanner) processLine(line []cToken) {
+  if len(line) == 0 {
+    return
+  }
+
+  if line[0].kind == C_PUNCT && line[0].text == "#" {
+    if len(line) > 1 {
+      s.processDirective(line[1].text, line[2:])
+    }
+
+    return
+  }
+
+  if s.active() == FALSE {
+    return
+  }
+
+  for _, tok := range line {
+    s.detectMain(tok)
+  }
+}
+
+// `int main(` or `auto main(` (possibly with whitespace or comments in between), but not `x.main(`
+func (s *CScanner) detectMain(tok cToken) {
+  n := len(s.prev)
+
+  if tok.kind == C_PUNCT && tok.text == "(" && n >= 2 {
+    typ, name := s.prev[n-2], s.prev[n-1]
+
+    if name.kind == C_IDENT && name.text == "main" && typ.kind == C_IDENT && (typ.text == "int" || typ.text == "auto") {
+      s.Main = true
+    }
+  }
+
+  s.prev = append(s.prev, tok)
+  if len(s.prev) > 2 {
+    s.prev = s.prev[1:]
+  }
+}
+
+func (s *CScanner) processDirective(name string, args []cToken) {
+  switch name {
+  case "include", "include_next", "import":
+    if s.active() == FALSE || len(args) == 0 {
+      return
+    }
+
+    // macro includes can't be resolved
+    arg := args[0]
+    if arg.kind == C_HEADER && arg.text != "" {
+      s.RawDeps = append(s.RawDeps, "<" + arg.text + ">")
+    } else if arg.kind == C_STRING && len(arg.text) > 2 && arg.text[0] == '"' && arg.text[len(arg.text)-1] == '"' {
+      s.RawDeps = append(s.RawDeps, arg.text[1:len(arg.text)-1])
+    }
+  case "if", "ifdef", "ifndef":
+    var cond tristate
+    switch name {
+    case "if":
+      cond = s.evalCond(args)
+    case "ifdef":
+      cond = s.evalDefined(args)
+    default:
+      cond = s.evalDefined(args).Not()
+    }
+
+    s.conds = append(s.conds, cCondFrame{s.active(), cond, cond})
+  case "elif", "elifdef", "elifndef", "else":
+    if len(s.conds) == 0 {
+      return
+    }
+
+    top := &s.conds[len(s.conds)-1]
+
+    var cond tristate
+    switch name {
+    case "elif":
+      cond = s.evalCond(args)
+    case "elifdef":
+      cond = s.evalDefined(args)
+    case "elifndef":
+      cond = s.evalDefined(args).Not()
+    default:
+      cond = TRUE
+    }
+
+    if top.taken == TRUE {
+      top.cond = FALSE
+    } else if top.taken == FALSE {
+      top.cond = cond
+    } else if cond == FALSE {
+      top.cond = FALSE
+    } else {
+      top.cond = UNKNOWN
+    }
+
+    top.taken = top.taken.Or(cond)
+  case "endif":
+    if len(s.conds) > 0 {
+      s.conds = s.conds[0 : len(s.conds)-1]
+    }
+  case "define", "undef":
+    if len(args) == 0 || args[0].kind != C_IDENT {
+      return
+    }
+
+    switch s.active() {
+    case TRUE:
+      if name == "define" {
+        s.defines[args[0].text] = TRUE
+      } else {
+        s.defines[args[0].text] = FALSE
+      }
+    case UNKNOWN:
+      delete(s.defines, args[0].text)
+    }
+  }
+}
+
+// only macros (un)defined in the same file are known
+func (s *CScanner) evalDefined(args []cToken) tristate {
+  if len(args) == 0 || args[0].kind != C_IDENT {
+    return UNKNOWN
+  }
+
+  return s.defines[args[0].text]
+}
+
+// handles `0`, `1`, `true`, `false`, `defined X`, `defined(X)`, and their negations
+func (s *CScanner) evalCond(args []cToken) tristate {
+  if len(args) > 0 && args[0].kind == C_PUNCT && args[0].text == "!" {
+    return s.evalCond(args[1:]).Not()
+  }
+
+  if len(args) == 1 {
+    arg := args[0]
+
+    switch {
+    case arg.kind == C_NUMBER:
+      return evalInt(arg.text)
+    case arg.kind == C_IDENT && arg.text == "false":
+      return FALSE
+    case arg.kind == C_IDENT && arg.text == "true":
+      return TRUE
+    }
+
+    return UNKNOWN
+  }
+
+  if len(args) > 0 && args[0].kind == C_IDENT && args[0].text == "defined" {
+    rest := args[1:]
+
+    if len(rest) == 1 {
+      return s.evalDefined(rest)
+    } else if len(rest) == 3 && rest[0].text == "(" && rest[2].text == ")" {
+      return s.evalDefined(rest[1:2])
+    }
+  }
+
+  return UNKNOWN
+}
+
+// integer literals with digit separators and u/l suffixes, in any base (e.g. `0x0`, `0b1`, `1'000ul`)
+func evalInt(text string) tristate {
+  lit := strings.TrimRight(strings.ReplaceAll(text, "'", ""), "uUlL")
+
+  // Go-only syntax (`1_000`, `0o17`) isn't valid C
+  if strings.ContainsRune(lit, '_') || strings.HasPrefix(lit, "0o") || strings.HasPrefix(lit, "0O") {
+    return UNKNOWN
+  }
+
+  v, err := strconv.ParseInt(lit, 0, 64)
+  if err != nil {
+    return UNKNOWN
+  }
+
+  if v == 0 {
+    return FALSE
+  }
+
+  return TRUE
+}
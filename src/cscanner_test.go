@@ -0,0 +1,102 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestEvalCond(t *testing.T) {
+  tests := []struct {
+    cond string
+    want tristate
+  }{
+    {"0", FALSE},
+    {"1", TRUE},
+    {"00", FALSE},
+    {"0x0", FALSE},
+    {"0X0", FALSE},
+    {"0x10", TRUE},
+    {"0b0", FALSE},
+    {"0B1", TRUE},
+    {"0L", FALSE},
+    {"0ull", FALSE},
+    {"1u", TRUE},
+    {"0'000", FALSE},
+    {"1'000", TRUE},
+    {"010", TRUE},
+    {"1.0", UNKNOWN},
+    {"1_000", UNKNOWN},
+    {"!0", TRUE},
+    {"!0x1", FALSE},
+    {"!!0", FALSE},
+    {"true", TRUE},
+    {"false", FALSE},
+    {"FOO", UNKNOWN},
+    {"defined FOO", UNKNOWN},
+    {"defined BAR", TRUE},
+    {"defined(BAR)", TRUE},
+    {"!defined(BAR)", FALSE},
+    {"defined(BAZ)", FALSE},
+    {"1 + 1", UNKNOWN},
+  }
+
+  for _, test := range tests {
+    s := NewCScanner([]byte("#define BAR\n#undef BAZ\n#if " + test.cond + "\n"))
+    s.Scan()
+
+    if len(s.conds) != 1 {
+      t.Fatalf("%q: expected one open conditional, got %d", test.cond, len(s.conds))
+    }
+
+    if got := s.conds[0].cond; got != test.want {
+      t.Errorf("%q: expected %d, got %d", test.cond, test.want, got)
+    }
+  }
+}
+
+func TestScanCSource(t *testing.T) {
+  tests := []struct {
+    name    string
+    src     string
+    head    string
+    rawDeps []string
+    main    bool
+  }{
+    {"quoted and system includes", "#include \"a.h\"\n#include <b.h>\n", "", []string{"a.h", "<b.h>"}, false},
+    {"spaces after hash", "#  include \"a.h\"\n  #\tinclude <b.h>\n", "", []string{"a.h", "<b.h>"}, false},
+    {"no space before header", "#include<x>\n#include\"y.h\"\n", "", []string{"<x>", "y.h"}, false},
+    {"include in block comment", "/*\n#include \"a.h\"\n*/\n#include \"b.h\"\n", "", []string{"b.h"}, false},
+    {"include in line comment", "// #include \"a.h\"\n", "", []string{}, false},
+    {"include in raw string", "const char *s = R\"x(\n#include \"a.h\"\n)x\";\n", "", []string{}, false},
+    {"include in string", "const char *s = \"#include <a.h>\";\n", "", []string{}, false},
+    {"bom and crlf", "\xEF\xBB\xBF//! exe app\r\n#include \"a.h\"\r\nint main() {}\r\n", "exe app", []string{"a.h"}, true},
+    {"if 0", "#if 0\n#include \"a.h\"\n#else\n#include \"b.h\"\n#endif\n", "", []string{"b.h"}, false},
+    {"if 1", "#if 1\n#include \"a.h\"\n#else\n#include \"b.h\"\n#endif\n", "", []string{"a.h"}, false},
+    {"unknown condition", "#if FOO\n#include \"a.h\"\n#else\n#include \"b.h\"\n#endif\n", "", []string{"a.h", "b.h"}, false},
+    {"main in if 0", "#if 0\nint main() {}\n#endif\n", "", []string{}, false},
+    {"main", "int main(int argc, char **argv) {}\n", "", []string{}, true},
+    {"main on next line", "int\nmain(void)\n{}\n", "", []string{}, true},
+    {"main with comment", "int /* entry */ main (void) {}\n", "", []string{}, true},
+    {"trailing return type", "auto main() -> int {}\n", "", []string{}, true},
+    {"main helper", "int main_helper(void) {}\n", "", []string{}, false},
+    {"mainx", "int mainx() {}\n", "", []string{}, false},
+    {"main call", "x = main();\n", "", []string{}, false},
+    {"main in comment", "// int main() {}\n", "", []string{}, false},
+  }
+
+  for _, test := range tests {
+    head, rawDeps, main := ScanCSource([]byte(test.src))
+
+    if head != test.head {
+      t.Errorf("%s: expected head %q, got %q", test.name, test.head, head)
+    }
+
+    if !reflect.DeepEqual(rawDeps, test.rawDeps) {
+      t.Errorf("%s: expected deps %v, got %v", test.name, test.rawDeps, rawDeps)
+    }
+
+    if main != test.main {
+      t.Errorf("%s: expected main %v, got %v", test.name, test.main, main)
+    }
+  }
+}
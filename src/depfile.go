@@ -0,0 +1,97 @@
+package main
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+)
+
+const (
+  DEPFILE_EXT = ".d"
+)
+
+// parses make-style depfiles (as emitted by `-MMD -MF <depfile>`), returns the abs paths of all prerequisites
+func ParseDepfile(path string) ([]string, error) {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  content := strings.ReplaceAll(string(b), "\r\n", "\n")
+  content = strings.ReplaceAll(content, "\\\n", " ")
+
+  deps := make([]string, 0)
+
+  for _, line := range strings.Split(content, "\n") {
+    tokens := splitDepfileLine(line)
+
+    // everything up to and including the first token ending with ':' are targets
+    iColon := -1
+    for i, token := range tokens {
+      if strings.HasSuffix(token, ":") {
+        iColon = i
+        break
+      }
+    }
+
+    if iColon == -1 {
+      continue
+    }
+
+    for _, token := range tokens[iColon+1:] {
+      dep, err := filepath.Abs(token)
+      if err != nil {
+        return nil, err
+      }
+
+      deps = append(deps, dep)
+    }
+  }
+
+  return SortUnique(deps), nil
+}
+
+// splits on whitespace, but respects `\ ` and `$$` escapes
+func splitDepfileLine(line string) []string {
+  tokens := make([]string, 0)
+
+  var b strings.Builder
+
+  flush := func() {
+    if b.Len() > 0 {
+      tokens = append(tokens, b.String())
+      b.Reset()
+    }
+  }
+
+  for i := 0; i < len(line); i++ {
+    c := line[i]
+
+    if c == '\\' && i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '#') {
+      b.WriteByte(line[i+1])
+      i++
+    } else if c == '$' && i+1 < len(line) && line[i+1] == '$' {
+      b.WriteByte('$')
+      i++
+    } else if c == ' ' || c == '\t' {
+      flush()
+    } else if c == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t') {
+      b.WriteByte(c)
+      if b.Len() == 1 {
+        // lone colon, attach to previous token
+        b.Reset()
+        if len(tokens) > 0 {
+          tokens[len(tokens)-1] += ":"
+        }
+      } else {
+        flush()
+      }
+    } else {
+      b.WriteByte(c)
+    }
+  }
+
+  flush()
+
+  return tokens
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
+  "crypto/sha256"
+  "encoding/hex"
   "io/ioutil"
   "os"
+  "path/filepath"
   "sort"
+  "sync"
   "time"
 )
 
 const (
-  CACHE_DIR_REL = ".cache/bake"
+  CACHE_DIR_REL    = ".cache/bake"
+  PROFILES_DIR_REL = "profiles"
 )
 
 var (
   CACHE_DIR     = ""
 )
 
-type Raw struct {
-  i int
-  n int
-  b []byte
+func InitCacheDir() error {
+  home := os.Getenv("HOME")
+  CACHE_DIR = filepath.Join(home, CACHE_DIR_REL)
+
+  return os.MkdirAll(CACHE_DIR, 0755)
 }
 
 type File struct {
@@ -28,76 +34,48 @@ type File struct {
   Head    string // whatever comes after the `//!` string on the first line
   RawDeps []string // #include "..." or import "..."
   Main    bool   // file contains a main function (we can use this to generate implicit exes)
+  Pkgs    []string // pkg-config packages from `//! pkg` lines
+  Public    bool   // header has a `//! public` line, and is installed
+  PublicDir string // subdir of the installed include dir
 
   Deps    map[string]*File
-}
 
-func NewFile(path string, modTime time.Time, head string, rawDeps []string, main bool) *File {
-  return &File{path, modTime, head, rawDeps, main, make(map[string]*File)}
+  hash      string // content hash, calculated lazily
+  hashMutex sync.Mutex
 }
 
-func NewRaw(path string) (*Raw, error) {
-  b, err := ioutil.ReadFile(path)
-  if err != nil {
-    return nil, err
+func NewFile(path string, modTime time.Time, head string, rawDeps []string, main bool) *File {
+  return &File{
+    Path:    path,
+    ModTime: modTime,
+    Head:    head,
+    RawDeps: rawDeps,
+    Main:    main,
+    Deps:    make(map[string]*File),
   }
-
-  return &Raw{0, len(b), b}, nil
 }
 
-func (r *Raw) NextMatch(pat []byte) (bool, bool) {
-  npat := len(pat)
-
-  if npat + r.i > r.n {
-    return false, true
-  }
-
-  for i := 0; i < npat; i++ {
-    if r.b[r.i + i] != pat[i] {
-      return false, false
-    }
-  }
+func HashBytes(b []byte) string {
+  h := sha256.Sum256(b)
 
-  r.i += npat
-
-  return true, false
+  return hex.EncodeToString(h[:])
 }
 
-func (r *Raw) NextLine() bool {
-  for i := r.i; i < r.n; i++ {
-    if r.b[i] == '\n' || r.b[i] == '\r' {
-      if i == r.n-1 {
-        r.i = i
-        return true
-      } else {
-        r.i = i+1
-        return false
-      }
-    }
-  }
-
-  r.i = r.n-1
-  return true
-}
+func (f *File) Hash() (string, error) {
+  f.hashMutex.Lock()
 
-func (r *Raw) RestOfLine() (string, bool) {
-  for i := r.i; i < r.n; i++ {
-    if r.b[i] == '\n' || r.b[i] == '\r' {
-      res := r.b[r.i:i]
+  defer f.hashMutex.Unlock()
 
-      if i == r.n-1 {
-        r.i = i
-        return  string(res), true
-      } else {
-        r.i = i + 1
-        return string(res), false
-      }
+  if f.hash == "" {
+    b, err := ioutil.ReadFile(f.Path)
+    if err != nil {
+      return "", err
     }
+
+    f.hash = HashBytes(b)
   }
 
-  res := r.b[r.i:r.n]
-  r.i = r.n-1
-  return string(res), true
+  return f.hash, nil
 }
 
 func (f *File) UniqDeps() {
@@ -122,28 +100,27 @@ func (f *File) UniqDeps() {
   f.Deps = res
 }
 
-func (f *File) DstUpToDate(dst string) bool {
-  isUpToDate := true
-  if stat, err := os.Stat(dst); err != nil {
-    isUpToDate = false
-  } else {
-    dstModTime := stat.ModTime()
-    if f.ModTime.After(dstModTime) {
-      isUpToDate = false
-    } else {
-      for _, dep := range f.Deps {
-        if dep.ModTime.After(dstModTime) {
-          isUpToDate = false
-          break
-        } else if !dep.DstUpToDate(dep.Path) {
-          isUpToDate = false
-          break
-        }
-      }
+// mod time based, returns nil if dst is up-to-date
+func (f *File) DstOutdated(dst string) *Reason {
+  stat, err := os.Stat(dst)
+  if err != nil {
+    return NewReason(REASON_MISSING, "")
+  }
+
+  dstModTime := stat.ModTime()
+  if f.ModTime.After(dstModTime) {
+    return NewReason(REASON_NEWER, f.Path)
+  }
+
+  for _, dep := range f.Deps {
+    if dep.ModTime.After(dstModTime) {
+      return NewReason(REASON_NEWER, dep.Path)
+    } else if reason := dep.DstOutdated(dep.Path); reason != nil {
+      return reason
     }
-  } 
+  }
 
-  return isUpToDate
+  return nil
 }
 
 func (f *File) listDeepRawDeps(visited []*File) []string {
@@ -168,6 +145,27 @@ func (f *File) listDeepRawDeps(visited []*File) []string {
   return deps
 }
 
+func (f *File) listDeepDeps(visited map[*File]bool) []*File {
+  if visited[f] {
+    return []*File{}
+  }
+
+  visited[f] = true
+
+  deps := []*File{f}
+
+  for _, dep := range f.Deps {
+    deps = append(deps, dep.listDeepDeps(visited)...)
+  }
+
+  return deps
+}
+
+// self and all (indirect) dependencies
+func (f *File) ListDeepDeps() []*File {
+  return SortUniqueFiles(f.listDeepDeps(make(map[*File]bool)))
+}
+
 func (f *File) ListDeepRawDeps() []string {
   visited := make([]*File, 0)
 
@@ -0,0 +1,385 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "go/build"
+  "go/parser"
+  "go/token"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  GOMOD = "go.mod"
+  GOSUM = "go.sum"
+)
+
+type GoProject struct {
+  ProjectData
+
+  modules map[string]string // module root dir -> module path
+}
+
+func NewGoProject(args []string) (Project, error) {
+  p := &GoProject{}
+
+  rem, err := p.ProjectData.InitProject(args)
+  if err != nil {
+    return nil, err
+  }
+
+  if err := AssertNoArgs(rem); err != nil {
+    return nil, err
+  }
+
+  p.files = make([]*File, 0)
+  p.modules = make(map[string]string)
+
+  if err := p.WalkFiles(func(path string, info os.FileInfo) error {
+    if filepath.Base(path) == GOMOD {
+      modPath, err := ParseGoModPath(path)
+      if err != nil {
+        return err
+      }
+
+      p.modules[filepath.Dir(path)] = modPath
+
+      return nil
+    }
+
+    if !p.IsGoFile(path) {
+      return nil
+    }
+
+    f, err := p.ParseGoFile(path, info.ModTime())
+    if err != nil {
+      return err
+    }
+
+    p.files = append(p.files, f)
+
+    return nil
+  }); err != nil {
+    return nil, err
+  }
+
+  return p, nil
+}
+
+// files excluded by build constraints (e.g. `//go:build ignore` generators) aren't part of their package
+func (p *GoProject) IsGoFile(path string) bool {
+  if filepath.Ext(path) != ".go" || strings.HasSuffix(path, "_test.go") {
+    return false
+  }
+
+  rel, err := filepath.Rel(p.root, filepath.Dir(path))
+  if err != nil {
+    return false
+  }
+
+  // ignored by the go tool as well
+  for _, d := range strings.Split(rel, string(filepath.Separator)) {
+    if d == "testdata" || d == "vendor" || strings.HasPrefix(d, "_") || (strings.HasPrefix(d, ".") && d != ".") {
+      return false
+    }
+  }
+
+  match, err := build.Default.MatchFile(filepath.Dir(path), filepath.Base(path))
+
+  return err == nil && match
+}
+
+func ParseGoModPath(path string) (string, error) {
+  fd, err := os.Open(path)
+  if err != nil {
+    return "", err
+  }
+
+  defer fd.Close()
+
+  scanner := bufio.NewScanner(fd)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if !strings.HasPrefix(line, "module") {
+      continue
+    }
+
+    if i := strings.Index(line, "//"); i > -1 {
+      line = line[0:i]
+    }
+
+    fs := strings.Fields(line)
+    if len(fs) != 2 || fs[0] != "module" {
+      continue
+    }
+
+    if modPath, err := strconv.Unquote(fs[1]); err == nil {
+      return modPath, nil
+    }
+
+    return fs[1], nil
+  }
+
+  if err := scanner.Err(); err != nil {
+    return "", err
+  }
+
+  return "", errors.New(path + " doesn't contain a module path")
+}
+
+func (p *GoProject) ParseGoFile(path string, modTime time.Time) (*File, error) {
+  fset := token.NewFileSet()
+
+  ast, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly|parser.ParseComments)
+  if err != nil {
+    return nil, err
+  }
+
+  head := ""
+  if len(ast.Comments) > 0 && fset.Position(ast.Comments[0].Pos()).Offset == 0 {
+    first := ast.Comments[0].List[0].Text
+    if strings.HasPrefix(first, string(HEAD_PAT)) {
+      head = strings.TrimSpace(strings.TrimPrefix(first, string(HEAD_PAT)))
+    }
+  }
+
+  rawDeps := make([]string, 0)
+  for _, imp := range ast.Imports {
+    rawDep, err := strconv.Unquote(imp.Path.Value)
+    if err != nil {
+      return nil, err
+    }
+
+    rawDeps = append(rawDeps, rawDep)
+  }
+
+  main := ast.Name.Name == "main"
+
+  return NewFile(path, modTime, head, rawDeps, main), nil
+}
+
+// nearest module root at or above dir, within the project root
+func (p *GoProject) FindModule(dir string) (string, string, bool) {
+  for {
+    if modPath, ok := p.modules[dir]; ok {
+      return dir, modPath, true
+    }
+
+    if dir == p.root || len(dir) <= 1 {
+      return "", "", false
+    }
+
+    dir = filepath.Dir(dir)
+  }
+}
+
+func (p *GoProject) ResolveDeps() error {
+  for _, f := range p.files {
+    _, modPath, ok := p.FindModule(filepath.Dir(f.Path))
+    if !ok {
+      continue
+    }
+
+    for _, rawDep := range f.RawDeps {
+      if rawDep != modPath && !strings.HasPrefix(rawDep, modPath + "/") {
+        continue
+      }
+
+      // the import might also belong to a nested module, so resolve via dirs
+      for modRoot, otherModPath := range p.modules {
+        if rawDep != otherModPath && !strings.HasPrefix(rawDep, otherModPath + "/") {
+          continue
+        }
+
+        depDir := filepath.Join(modRoot, filepath.FromSlash(strings.TrimPrefix(rawDep, otherModPath)))
+
+        for _, dep := range p.PackageFiles(depDir) {
+          f.Deps[dep.Path] = dep
+        }
+      }
+    }
+
+    f.UniqDeps()
+  }
+
+  return nil
+}
+
+func (p *GoProject) PackageFiles(dir string) []*File {
+  return p.FilterFiles(func(f *File) bool {
+    return filepath.Dir(f.Path) == dir
+  })
+}
+
+// one file per main package
+func (p *GoProject) ListMainFiles() []*File {
+  mainFiles := make([]*File, 0)
+
+  dirs := make([]string, 0)
+  for _, f := range p.files {
+    if f.Main {
+      dirs = append(dirs, filepath.Dir(f.Path))
+    }
+  }
+
+  for _, dir := range SortUnique(dirs) {
+    pkgFiles := SortUniqueFiles(p.PackageFiles(dir))
+
+    mainFile := pkgFiles[0]
+    for _, f := range pkgFiles {
+      if strings.HasPrefix(f.Head, "exe") {
+        mainFile = f
+        break
+      }
+    }
+
+    mainFiles = append(mainFiles, mainFile)
+  }
+
+  return mainFiles
+}
+
+func (p *GoProject) ExeName(f *File) string {
+  if strings.HasPrefix(f.Head, "exe") {
+    fs := strings.Fields(f.Head)
+
+    if len(fs) > 1 {
+      return fs[1]
+    }
+  }
+
+  return filepath.Base(filepath.Dir(f.Path))
+}
+
+func (p *GoProject) ExePath(f *File) string {
+  return filepath.Join(p.dstDir, p.ExeName(f))
+}
+
+func (p *GoProject) ExeOutdated(f *File) *Reason {
+  dst := p.ExePath(f)
+
+  stat, err := os.Stat(dst)
+  if err != nil {
+    return NewReason(REASON_MISSING, "")
+  }
+
+  for _, pkgFile := range p.PackageFiles(filepath.Dir(f.Path)) {
+    if reason := pkgFile.DstOutdated(dst); reason != nil {
+      return reason
+    }
+  }
+
+  if modRoot, _, ok := p.FindModule(filepath.Dir(f.Path)); ok {
+    for _, name := range []string{GOMOD, GOSUM} {
+      path := filepath.Join(modRoot, name)
+      if modStat, err := os.Stat(path); err == nil && modStat.ModTime().After(stat.ModTime()) {
+        return NewReason(REASON_NEWER, path)
+      }
+    }
+  }
+
+  return nil
+}
+
+func (p *GoProject) Build() error {
+  exeFiles := FilterFiles(p.ListMainFiles(), func(f *File) bool {
+    return p.NeedsRebuild("exe", p.ExePath(f), func() *Reason { return p.ExeOutdated(f) })
+  })
+
+  s := p.NewScheduler()
+
+  for _, f := range exeFiles {
+    f := f
+
+    s.Add(func() error {
+      return p.CompileExe(f)
+    })
+  }
+
+  return s.Run()
+}
+
+func (p *GoProject) BuildTarget(target string) error {
+  exeFiles := FilterFiles(p.ListMainFiles(), func(f *File) bool {
+    return p.ExeName(f) == target
+  })
+
+  if len(exeFiles) == 0 {
+    return errors.New("bake target " + target + " not found")
+  } else if len(exeFiles) > 1 {
+    return errors.New("bake target " + target + " ambiguous")
+  }
+
+  exeFile := exeFiles[0]
+
+  if !p.NeedsRebuild("exe", p.ExePath(exeFile), func() *Reason { return p.ExeOutdated(exeFile) }) {
+    return nil
+  }
+
+  return p.CompileExe(exeFile)
+}
+
+func (p *GoProject) TargetExePath(target string) (string, error) {
+  exeFiles := FilterFiles(p.ListMainFiles(), func(f *File) bool {
+    return p.ExeName(f) == target
+  })
+
+  if len(exeFiles) != 1 {
+    return "", errors.New("bake target " + target + " not found or ambiguous")
+  }
+
+  return p.ExePath(exeFiles[0]), nil
+}
+
+func (p *GoProject) WriteCompDB() error {
+  return errors.New("--compdb is only supported by c projects")
+}
+
+func (p *GoProject) WriteGraph(format string, target string) error {
+  return errors.New("--graph is only supported by c projects")
+}
+
+func (p *GoProject) Watch(target string) error {
+  return errors.New("--watch is only supported by c projects")
+}
+
+func (p *GoProject) Test() error {
+  return errors.New("--test is only supported by c projects (use go test)")
+}
+
+func (p *GoProject) CompileExe(f *File) error {
+  pkgDir := filepath.Dir(f.Path)
+
+  modRoot, _, ok := p.FindModule(pkgDir)
+  if !ok {
+    return errors.New("no " + GOMOD + " found for " + pkgDir)
+  }
+
+  rel, err := filepath.Rel(modRoot, pkgDir)
+  if err != nil {
+    return err
+  }
+
+  cmdName := "go"
+  cmdArgs := []string{"build", "-o", p.ExePath(f), "./" + filepath.ToSlash(rel)}
+
+  p.PrintCommand(cmdName, cmdArgs)
+
+  if !p.dryRun {
+    // -f removes the exe, so that it's relinked, packages are still taken from the go build cache if their inputs are unchanged
+    // (-a would also rebuild the std lib and all deps)
+    if p.force {
+      if err := os.Remove(p.ExePath(f)); err != nil && !os.IsNotExist(err) {
+        return err
+      }
+    }
+
+    return p.CommandError(cmdName, cmdArgs, RunCommandInDir(modRoot, cmdName, cmdArgs))
+  } else {
+    return nil
+  }
+}
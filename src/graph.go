@@ -0,0 +1,206 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const (
+  GRAPH_DOT  = "dot"
+  GRAPH_JSON = "json"
+)
+
+type GraphFile struct {
+  Path     string   `json:"path"`
+  Kind     string   `json:"kind"` // source, header, exe, lib, test or pch
+  Includes []string `json:"includes"`
+}
+
+type GraphTarget struct {
+  Name    string   `json:"name"`
+  Kind    string   `json:"kind"` // exe, lib or test
+  Source  string   `json:"source"`
+  Output  string   `json:"output"`
+  Objects []string `json:"objects"` // sources of the linked objects
+}
+
+// paths are relative to the project root
+type Graph struct {
+  Files   []GraphFile   `json:"files"`
+  Targets []GraphTarget `json:"targets"`
+}
+
+func (p *CProject) relPath(path string) string {
+  if rel, err := filepath.Rel(p.root, path); err == nil {
+    return rel
+  }
+
+  return path
+}
+
+func (p *CProject) graphFileKind(f *File) string {
+  if p.IsExeFile(f) {
+    return "exe"
+  } else if p.IsLibFile(f) {
+    return "lib"
+  } else if p.IsTestFile(f) {
+    return "test"
+  } else if p.IsPchFile(f) {
+    return "pch"
+  } else if p.IsHFile(f.Path) {
+    return "header"
+  } else {
+    return "source"
+  }
+}
+
+func (p *CProject) graphTarget(f *File) GraphTarget {
+  t := GraphTarget{"", p.graphFileKind(f), p.relPath(f.Path), "", make([]string, 0)}
+
+  var objFiles []*File
+
+  if p.IsLibFile(f) {
+    t.Name = p.LibName(f)
+    t.Output = p.relPath(p.LibPath(f))
+    objFiles = p.ListLibObjFiles(f)
+  } else {
+    t.Name = p.ExeName(f)
+    t.Output = p.relPath(p.ExePath(f))
+    objFiles = p.ListExeObjFiles(f)
+  }
+
+  for _, obj := range objFiles {
+    t.Objects = append(t.Objects, p.relPath(obj.Path))
+  }
+
+  return t
+}
+
+// if target isn't empty, only the files used to build that target are included
+func (p *CProject) BuildGraph(target string) (*Graph, error) {
+  targetFiles := p.FilterFiles(func(f *File) bool {
+    return p.IsExeFile(f) || p.IsLibFile(f) || p.IsTestFile(f)
+  })
+
+  files := p.files
+
+  if target != "" {
+    targetFiles = FilterFiles(targetFiles, func(f *File) bool {
+      if p.IsLibFile(f) {
+        return p.LibName(f) == target
+      } else {
+        return p.ExeName(f) == target
+      }
+    })
+
+    if len(targetFiles) == 0 {
+      return nil, errors.New("bake target " + target + " not found")
+    } else if len(targetFiles) > 1 {
+      return nil, errors.New("bake target " + target + " ambiguous")
+    }
+
+    t := targetFiles[0]
+
+    objFiles := p.ListExeObjFiles(t)
+    if p.IsLibFile(t) {
+      objFiles = append(p.ListLibObjFiles(t), t)
+    }
+
+    files = make([]*File, 0)
+    for _, obj := range objFiles {
+      files = append(files, obj.ListDeepDeps()...)
+    }
+  }
+
+  g := &Graph{make([]GraphFile, 0), make([]GraphTarget, 0)}
+
+  for _, f := range SortUniqueFiles(files) {
+    includes := make([]string, 0)
+    for _, dep := range f.Deps {
+      includes = append(includes, p.relPath(dep.Path))
+    }
+
+    sort.Strings(includes)
+
+    g.Files = append(g.Files, GraphFile{p.relPath(f.Path), p.graphFileKind(f), includes})
+  }
+
+  for _, f := range targetFiles {
+    g.Targets = append(g.Targets, p.graphTarget(f))
+  }
+
+  sort.Slice(g.Targets, func(i, j int) bool {
+    return g.Targets[i].Name < g.Targets[j].Name
+  })
+
+  return g, nil
+}
+
+func (g *Graph) WriteJSON() error {
+  b, err := json.MarshalIndent(g, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  fmt.Println(string(b))
+
+  return nil
+}
+
+// include edges are solid, edges from targets to their linked objects are dashed
+func (g *Graph) WriteDot() {
+  var b strings.Builder
+
+  b.WriteString("digraph bake {\n")
+  b.WriteString("  rankdir=LR;\n")
+  b.WriteString("  node [shape=box];\n")
+
+  for _, f := range g.Files {
+    if f.Kind == "header" || f.Kind == "pch" {
+      b.WriteString(fmt.Sprintf("  %q [shape=note];\n", f.Path))
+    } else {
+      b.WriteString(fmt.Sprintf("  %q;\n", f.Path))
+    }
+  }
+
+  for _, f := range g.Files {
+    for _, inc := range f.Includes {
+      b.WriteString(fmt.Sprintf("  %q -> %q;\n", f.Path, inc))
+    }
+  }
+
+  for _, t := range g.Targets {
+    id := t.Kind + ":" + t.Name
+
+    b.WriteString(fmt.Sprintf("  %q [shape=doubleoctagon, label=%q];\n", id, t.Kind + " " + t.Name + "\n" + t.Output))
+
+    for _, obj := range t.Objects {
+      b.WriteString(fmt.Sprintf("  %q -> %q [style=dashed];\n", id, obj))
+    }
+  }
+
+  b.WriteString("}\n")
+
+  fmt.Print(b.String())
+}
+
+func (p *CProject) WriteGraph(format string, target string) error {
+  g, err := p.BuildGraph(target)
+  if err != nil {
+    return err
+  }
+
+  switch format {
+  case "", GRAPH_DOT:
+    g.WriteDot()
+    return nil
+  case GRAPH_JSON:
+    return g.WriteJSON()
+  default:
+    return errors.New("unrecognized graph format " + format + " (expected dot or json)")
+  }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+var (
+  COMPILER_NAME_RE = regexp.MustCompile(`^(gcc|clang)(-[0-9]+)?$`)
+)
+
+// a C compiler found in the PATH, along with its C++ counterpart
+type Toolchain struct {
+  CC      string // e.g. gcc or clang-14
+  CXX     string // e.g. g++ or clang++-14, empty if not installed
+  Version string
+}
+
+func (t *Toolchain) IsClang() bool {
+  return strings.HasPrefix(t.CC, "clang")
+}
+
+func (t *Toolchain) MajorVersion() int {
+  n, _ := strconv.Atoi(strings.Split(t.Version, ".")[0])
+
+  return n
+}
+
+// clang is preferred, newer versions first
+func DetectToolchains() []*Toolchain {
+  names := make(map[string]bool)
+
+  for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+      continue
+    }
+
+    for _, info := range infos {
+      if COMPILER_NAME_RE.MatchString(info.Name()) {
+        names[info.Name()] = true
+      }
+    }
+  }
+
+  res := make([]*Toolchain, 0)
+
+  for name := range names {
+    if _, err := exec.LookPath(name); err != nil {
+      continue
+    }
+
+    out, err := exec.Command(name, "-dumpversion").Output()
+    if err != nil {
+      continue
+    }
+
+    cxx := strings.Replace(strings.Replace(name, "clang", "clang++", 1), "gcc", "g++", 1)
+    if _, err := exec.LookPath(cxx); err != nil {
+      cxx = ""
+    }
+
+    res = append(res, &Toolchain{name, cxx, strings.TrimSpace(string(out))})
+  }
+
+  sort.Slice(res, func(i, j int) bool {
+    a, b := res[i], res[j]
+
+    if a.IsClang() != b.IsClang() {
+      return a.IsClang()
+    } else if a.MajorVersion() != b.MajorVersion() {
+      return a.MajorVersion() > b.MajorVersion()
+    } else {
+      return a.CC < b.CC
+    }
+  })
+
+  return res
+}
+
+type InitAnswers struct {
+  ProjectType string
+  Toolchain   *Toolchain
+  Dialect     string
+  DstDir      string
+  Pch         bool
+}
+
+func (a *InitAnswers) IsCpp() bool {
+  return strings.Contains(a.Dialect, "++")
+}
+
+func (a *InitAnswers) Compiler() string {
+  if a.IsCpp() && a.Toolchain.CXX != "" {
+    return a.Toolchain.CXX
+  }
+
+  return a.Toolchain.CC
+}
+
+// asks questions on stderr (so that stdout can be redirected), reads answers from stdin
+// if yes is set (or stdin is closed) the defaults are used
+type InitWizard struct {
+  yes    bool
+  reader *bufio.Reader
+}
+
+func NewInitWizard(yes bool) *InitWizard {
+  return &InitWizard{yes, bufio.NewReader(os.Stdin)}
+}
+
+// an empty answer selects the default, answers must be one of options (unless options is empty)
+func (w *InitWizard) Ask(question string, def string, options []string) (string, error) {
+  for {
+    if len(options) > 0 {
+      fmt.Fprintf(os.Stderr, "%s (%s) [%s]: ", question, strings.Join(options, "/"), def)
+    } else {
+      fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+    }
+
+    if w.yes {
+      fmt.Fprintln(os.Stderr, def)
+      return def, nil
+    }
+
+    line, err := w.reader.ReadString('\n')
+    if err == io.EOF && line == "" {
+      fmt.Fprintln(os.Stderr, def)
+      w.yes = true
+      return def, nil
+    } else if err != nil && err != io.EOF {
+      return "", err
+    }
+
+    answer := strings.TrimSpace(line)
+    if answer == "" {
+      return def, nil
+    }
+
+    if len(options) == 0 || ContainsString(options, answer) {
+      return answer, nil
+    }
+
+    fmt.Fprintf(os.Stderr, "invalid answer %s\n", answer)
+  }
+}
+
+func (w *InitWizard) AskYesNo(question string, def bool) (bool, error) {
+  defStr := "n"
+  if def {
+    defStr = "y"
+  }
+
+  answer, err := w.Ask(question, defStr, []string{"y", "n"})
+  if err != nil {
+    return false, err
+  }
+
+  return answer == "y", nil
+}
+
+func (w *InitWizard) Run(dir string) (*InitAnswers, error) {
+  a := &InitAnswers{}
+
+  info, err := probeProjectDir(dir)
+  if err != nil {
+    return nil, err
+  }
+
+  a.ProjectType, err = w.Ask("project type", info.projectType, []string{"c", "go"})
+  if err != nil {
+    return nil, err
+  }
+
+  a.DstDir, err = w.Ask("output dir", "./build/", nil)
+  if err != nil {
+    return nil, err
+  }
+
+  if a.ProjectType == "go" {
+    return a, nil
+  }
+
+  toolchains := DetectToolchains()
+  if len(toolchains) == 0 {
+    return nil, errors.New("no gcc or clang found in PATH")
+  }
+
+  names := make([]string, 0)
+  for _, t := range toolchains {
+    names = append(names, t.CC)
+    fmt.Fprintf(os.Stderr, "found %s %s\n", t.CC, t.Version)
+  }
+
+  cc, err := w.Ask("compiler", names[0], names)
+  if err != nil {
+    return nil, err
+  }
+
+  a.Toolchain = toolchains[FindString(names, cc)]
+
+  a.Dialect, err = w.Ask("dialect", defaultDialect(a.Toolchain, info.hasCpp), nil)
+  if err != nil {
+    return nil, err
+  }
+
+  if a.IsCpp() && a.Toolchain.CXX == "" {
+    fmt.Fprintf(os.Stderr, "warning: C++ compiler for %s not found, using %s\n", a.Toolchain.CC, a.Toolchain.CC)
+  }
+
+  if info.pchHeader != "" {
+    if a.Toolchain.IsClang() {
+      a.Pch, err = w.AskYesNo("use " + info.pchHeader + " as precompiled header", true)
+      if err != nil {
+        return nil, err
+      }
+    } else {
+      fmt.Fprintf(os.Stderr, "found pch header %s, but precompiled headers are only supported with clang\n", info.pchHeader)
+    }
+  }
+
+  return a, nil
+}
+
+// c++2a instead of c++20 for older compilers
+func defaultDialect(t *Toolchain, cpp bool) string {
+  if !cpp {
+    return "c17"
+  }
+
+  if t.MajorVersion() < 10 {
+    return "c++2a"
+  }
+
+  return "c++20"
+}
+
+type projectDirInfo struct {
+  projectType string
+  hasCpp      bool
+  pchHeader   string // relative path, empty if there isn't a `//! pch` header
+}
+
+func probeProjectDir(dir string) (*projectDirInfo, error) {
+  info := &projectDirInfo{"c", false, ""}
+
+  if _, err := os.Stat(filepath.Join(dir, GOMOD)); err == nil {
+    info.projectType = "go"
+  }
+
+  if err := WalkFiles(dir, func(path string, fi os.FileInfo) error {
+    ext := filepath.Ext(path)
+
+    if ext != ".c" && ext != ".h" && ContainsString(HCEXTS, ext) {
+      info.hasCpp = true
+    }
+
+    if info.pchHeader == "" && ContainsString(HEXTS, ext) {
+      b, err := ioutil.ReadFile(path)
+      if err != nil {
+        return err
+      }
+
+      if head, _ := SplitCHead(b); strings.HasPrefix(head, "pch") {
+        info.pchHeader, err = filepath.Rel(dir, path)
+        if err != nil {
+          return err
+        }
+      }
+    }
+
+    return nil
+  }); err != nil {
+    return nil, err
+  }
+
+  return info, nil
+}
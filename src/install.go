@@ -0,0 +1,155 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const (
+  DEFAULT_PREFIX  = "/usr/local"
+  PUBLIC_HEAD_PAT = "//! public"
+)
+
+// `//! public [<subdir>]` marks a header for installation in <prefix>/include[/<subdir>]
+// returns false if the header isn't public
+func ScanPublicHead(b []byte) (bool, string) {
+  for _, line := range strings.Split(string(b), "\n") {
+    line = strings.TrimSpace(line)
+
+    if line == PUBLIC_HEAD_PAT || strings.HasPrefix(line, PUBLIC_HEAD_PAT + " ") {
+      return true, strings.TrimSpace(strings.TrimPrefix(line, PUBLIC_HEAD_PAT))
+    }
+  }
+
+  return false, ""
+}
+
+// DESTDIR is prepended to the prefix, for staged installs
+func InstallDir(prefix string, kind string) string {
+  return filepath.Join(os.Getenv("DESTDIR"), prefix, kind)
+}
+
+// dst -> src
+type Installs map[string]string
+
+// different srcs with the same dst (e.g. two public util.h headers in different dirs) are an error
+func (is Installs) Add(src string, dstDir string) error {
+  dst := filepath.Join(dstDir, filepath.Base(src))
+
+  if other, ok := is[dst]; ok && other != src {
+    return errors.New("both " + other + " and " + src + " would be installed as " + dst)
+  }
+
+  is[dst] = src
+
+  return nil
+}
+
+func (p *ProjectData) InstallAll(is Installs) error {
+  dsts := make([]string, 0)
+  for dst := range is {
+    dsts = append(dsts, dst)
+  }
+
+  sort.Strings(dsts)
+
+  for _, dst := range dsts {
+    if err := p.InstallFile(is[dst], dst); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// the permissions of src are preserved, dsts with the same content and permissions are skipped
+func (p *ProjectData) InstallFile(src string, dst string) error {
+  srcStat, err := os.Stat(src)
+  if err != nil {
+    // not built in dry-run mode
+    if p.dryRun && os.IsNotExist(err) {
+      fmt.Printf("install %s %s\n", p.FormatPath(src), dst)
+      return nil
+    }
+
+    return err
+  }
+
+  content, err := ioutil.ReadFile(src)
+  if err != nil {
+    return err
+  }
+
+  if dstStat, err := os.Stat(dst); err == nil && dstStat.Mode().Perm() == srcStat.Mode().Perm() {
+    if old, err := ioutil.ReadFile(dst); err == nil && bytes.Equal(old, content) {
+      return nil
+    }
+  }
+
+  fmt.Printf("install %s %s\n", p.FormatPath(src), dst)
+
+  if p.dryRun {
+    return nil
+  }
+
+  if err := WriteFileAtomic(dst, content); err != nil {
+    return err
+  }
+
+  return os.Chmod(dst, srcStat.Mode().Perm())
+}
+
+// exes go to <prefix>/bin, libs to <prefix>/lib, and public headers to <prefix>/include
+func (p *CProject) Install(prefix string) error {
+  if err := p.Build(); err != nil {
+    return err
+  }
+
+  is := make(Installs)
+
+  for _, f := range p.FilterFiles(p.IsExeFile) {
+    if err := is.Add(p.ExePath(f), InstallDir(prefix, "bin")); err != nil {
+      return err
+    }
+  }
+
+  for _, f := range p.FilterFiles(p.IsLibFile) {
+    if err := is.Add(p.LibPath(f), InstallDir(prefix, "lib")); err != nil {
+      return err
+    }
+  }
+
+  for _, f := range p.FilterFiles(func(f *File) bool { return p.IsHFile(f.Path) && f.Public }) {
+    if filepath.IsAbs(f.PublicDir) || ContainsString(strings.Split(filepath.ToSlash(f.PublicDir), "/"), "..") {
+      return errors.New(p.FormatPath(f.Path) + ": invalid public dir " + f.PublicDir + " (must be relative to the include dir)")
+    }
+
+    if err := is.Add(f.Path, filepath.Join(InstallDir(prefix, "include"), f.PublicDir)); err != nil {
+      return err
+    }
+  }
+
+  return p.InstallAll(is)
+}
+
+func (p *GoProject) Install(prefix string) error {
+  if err := p.Build(); err != nil {
+    return err
+  }
+
+  is := make(Installs)
+
+  for _, f := range p.ListMainFiles() {
+    if err := is.Add(p.ExePath(f), InstallDir(prefix, "bin")); err != nil {
+      return err
+    }
+  }
+
+  return p.InstallAll(is)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+const (
+  USER_LIBMAP_REL = "bake/libs"
+)
+
+// maps system includes (globs like `<zlib.h>` or `<GL/*>`) to libs, extra linker flags and pkg-config packages
+type LibRule struct {
+  Pattern string
+  Libs    []string
+  Flags   []string
+  Pkgs    []string
+}
+
+type LibMap struct {
+  rules []*LibRule
+}
+
+func DefaultLibMap() *LibMap {
+  m := &LibMap{make([]*LibRule, 0)}
+
+  m.Set("<math.h>", []string{"m"})
+  m.Set("<cmath>", []string{"m"})
+  m.Set("<OpenCL/cl2*>", []string{"OpenCL"})
+
+  for _, header := range []string{"<iostream>", "<string>", "<concepts>", "<utility>", "<map>", "<vector>", "<type_traits>", "<memory>", "<sstream>"} {
+    m.Set(header, []string{"stdc++"})
+  }
+
+  return m
+}
+
+// $XDG_CONFIG_HOME/bake/libs, or ~/.config/bake/libs
+func UserLibMapPath() (string, error) {
+  if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+    return filepath.Join(dir, USER_LIBMAP_REL), nil
+  }
+
+  home, err := os.UserHomeDir()
+  if err != nil {
+    return "", err
+  }
+
+  return filepath.Join(home, ".config", USER_LIBMAP_REL), nil
+}
+
+// the defaults, overridden by the user lib map file, overridden by the lib-map of the project config
+func LoadLibMap(projectMap map[string][]string) (*LibMap, error) {
+  m := DefaultLibMap()
+
+  userPath, err := UserLibMapPath()
+  if err != nil {
+    return nil, err
+  }
+
+  if err := m.ReadFile(userPath); err != nil {
+    return nil, err
+  }
+
+  patterns := make([]string, 0)
+  for pattern := range projectMap {
+    patterns = append(patterns, pattern)
+  }
+
+  sort.Strings(patterns)
+
+  for _, pattern := range patterns {
+    if err := m.SetChecked(pattern, projectMap[pattern]); err != nil {
+      return nil, err
+    }
+  }
+
+  return m, nil
+}
+
+// args starting with `-` are linker flags, args starting with `pkg:` are pkg-config packages, the others are lib names
+// a rule with the same pattern is replaced, so that rules can also be disabled by mapping to nothing
+func (m *LibMap) Set(pattern string, args []string) {
+  rule := &LibRule{pattern, make([]string, 0), make([]string, 0), make([]string, 0)}
+
+  for _, arg := range args {
+    if strings.HasPrefix(arg, "-") {
+      rule.Flags = append(rule.Flags, arg)
+    } else if strings.HasPrefix(arg, PKG_PREFIX) {
+      rule.Pkgs = append(rule.Pkgs, strings.TrimPrefix(arg, PKG_PREFIX))
+    } else {
+      rule.Libs = append(rule.Libs, arg)
+    }
+  }
+
+  for i, other := range m.rules {
+    if other.Pattern == pattern {
+      m.rules[i] = rule
+      return
+    }
+  }
+
+  m.rules = append(m.rules, rule)
+}
+
+func (m *LibMap) SetChecked(pattern string, args []string) error {
+  if _, err := path.Match(pattern, ""); err != nil {
+    return errors.New("invalid lib map pattern " + pattern)
+  }
+
+  m.Set(pattern, args)
+
+  return nil
+}
+
+// format: one `<pattern> <lib-or-flag>...` rule per line, `#` starts a comment
+// a missing file is ignored
+func (m *LibMap) ReadFile(fname string) error {
+  b, err := ioutil.ReadFile(fname)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil
+    }
+
+    return err
+  }
+
+  for i, line := range strings.Split(string(b), "\n") {
+    if j := strings.Index(line, "#"); j > -1 {
+      line = line[0:j]
+    }
+
+    fs := strings.Fields(line)
+    if len(fs) == 0 {
+      continue
+    }
+
+    if err := m.SetChecked(fs[0], fs[1:]); err != nil {
+      return errors.New(fname + ":" + strconv.Itoa(i+1) + ": " + err.Error())
+    }
+  }
+
+  return nil
+}
+
+// deps are raw includes, only system includes (`<...>`) are matched
+// returns the unique libs, flags and packages, in order of the rules
+func (m *LibMap) Resolve(deps []string) ([]string, []string, []string) {
+  libs := make([]string, 0)
+  flags := make([]string, 0)
+  pkgs := make([]string, 0)
+
+  for _, rule := range m.rules {
+    for _, dep := range deps {
+      if len(dep) <= 2 || dep[0] != '<' || dep[len(dep)-1] != '>' {
+        continue
+      }
+
+      if ok, _ := path.Match(rule.Pattern, dep); ok {
+        for _, lib := range rule.Libs {
+          if !ContainsString(libs, lib) {
+            libs = append(libs, lib)
+          }
+        }
+
+        for _, flag := range rule.Flags {
+          if !ContainsString(flags, flag) {
+            flags = append(flags, flag)
+          }
+        }
+
+        for _, pkg := range rule.Pkgs {
+          if !ContainsString(pkgs, pkg) {
+            pkgs = append(pkgs, pkg)
+          }
+        }
+
+        break
+      }
+    }
+  }
+
+  return libs, flags, pkgs
+}
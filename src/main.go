@@ -3,13 +3,20 @@ package main
 import (
   "errors"
   "fmt"
+  "io/ioutil"
   "os"
+  "os/exec"
   "path/filepath"
   "strings"
+  "time"
 )
 
 func main() {
   if err := mainInner(); err != nil {
+    if exitErr, ok := err.(*ExitCodeError); ok {
+      os.Exit(exitErr.Code)
+    }
+
     fmt.Fprintf(os.Stderr, "%s\n", err.Error())
     os.Exit(1)
   }
@@ -20,16 +27,46 @@ func printUsage() {
 
   b.WriteString("bake [MODE | [TARGET]] [OPTIONS]\n")
   b.WriteString("\nModes:\n")
-  b.WriteString("  --init            wizard to create new makefile recipe\n")
-  b.WriteString("  --project <type>  go or c\n")
+  b.WriteString("  --init [--yes]    wizard to create new makefile recipe, probes the toolchain (--yes: accept the defaults)\n")
+  b.WriteString("  --project [<type>] go or c (default: from bake.toml/bake.json)\n")
+  b.WriteString("  --compdb          write compile_commands.json, without compiling\n")
+  b.WriteString("  --test [--junit <file>] [--timeout <duration>]\n")
+  b.WriteString("                    build and run the `//! test` targets (default junit report: <dst>/tests/junit.xml,\n")
+  b.WriteString("                    default timeout per test: 10m)\n")
+  b.WriteString("  --graph [dot|json] [<target>]\n")
+  b.WriteString("                    print the include graph and the objects linked into each target\n")
+  b.WriteString("  --watch [<target>] rebuild whenever a source or header changes\n")
+  b.WriteString("  --install [--prefix <dir>]\n")
+  b.WriteString("                    build, then copy exes to <prefix>/bin, libs to <prefix>/lib and `//! public` headers\n")
+  b.WriteString("                    to <prefix>/include (default prefix: /usr/local, DESTDIR is prepended)\n")
+  b.WriteString("  run <target> [-- <args>]\n")
+  b.WriteString("                    build an exe, then run it with args\n")
+  b.WriteString("  --cache <cmd>     manage the object cache:\n")
+  b.WriteString("                      stats\n")
+  b.WriteString("                      prune [--max-age <age>] [--max-size <size>] [--orphans]\n")
+  b.WriteString("                      verify [--fix]\n")
+  b.WriteString("                      clear [--all]\n")
+  b.WriteString("  --cache-server <dir> [--listen <addr>]\n")
+  b.WriteString("                    serve a remote object cache from dir\n")
   b.WriteString("\nProject mode options:\n")
   b.WriteString("  --compiler <compiler-cmd>\n")
   b.WriteString("  --linker   <linker-cmd>\n")
+  b.WriteString("  --lib-linker <lib-linker-cmd>\n")
+  b.WriteString("  --archiver <archiver-cmd>\n")
   b.WriteString("  --pch      <pch-cmd>\n")
   b.WriteString("  --dst      <dst-dir>\n")
+  b.WriteString("  --include <glob>  only discover the matching sources and headers (repeatable)\n")
+  b.WriteString("  --exclude <glob>  skip the matching files and dirs, in addition to .gitignore and .bakeignore (repeatable)\n")
+  b.WriteString("  --follow-symlinks follow symlinked dirs during source discovery\n")
+  b.WriteString("  --remote-cache <url> (or BAKE_REMOTE_CACHE, set BAKE_REMOTE_CACHE_READONLY to disable uploads)\n")
+  b.WriteString("                    shares objects (not pchs) between machines with the same compiler version\n")
   b.WriteString("\nGeneral options:\n")
   b.WriteString("  -f/-B             force\n")
   b.WriteString("  -n                dry-run\n")
+  b.WriteString("  -k                keep going, report all failed commands at the end\n")
+  b.WriteString("  --why             print the reason for every rebuilt object, pch, lib and exe\n")
+  b.WriteString("  --profile <name>  build profile, selects the --<option>.<name> project options\n")
+  b.WriteString("  -j <n>            number of parallel jobs (default: number of cpus)\n")
   b.WriteString("  -C <dir>          change directory\n")
   b.WriteString("  -h                display this message\n")
 
@@ -39,13 +76,50 @@ func printUsage() {
 func mainInner() error {
   args := os.Args[1:]
 
+  // args after `--` are meant for the exe of `bake run`, so they aren't searched for global flags
+  tail := []string{}
+  if i := FindString(args, "--"); i > -1 {
+    args, tail = args[0:i], args[i:]
+  }
+
   if ContainsHelp(args) {
     printUsage()
     return nil
   }
 
+  // the profile is passed to bake project recipes via the BAKE_PROFILE env variable
+  profile := ""
+  args, err := ParseStringFlags(args, []string{"--profile"}, []*string{&profile})
+  if err != nil {
+    return err
+  }
+
+  // --why can be combined with any mode, and is passed via the BAKE_WHY env variable
+  why := false
+  args = ParseBoolFlags(args, []string{"--why"}, []*bool{&why})
+
+  if why {
+    if err := os.Setenv("BAKE_WHY", "true"); err != nil {
+      return err
+    }
+  }
+
+  if profile != "" {
+    if err := AssertValidProfile(profile); err != nil {
+      return err
+    }
+
+    if err := os.Setenv("BAKE_PROFILE", profile); err != nil {
+      return err
+    }
+  }
+
+  args = append(args, tail...)
+
   if len(args) == 0 {
     return mainMake([]string{})
+  } else if args[0] == "run" {
+    return mainRun(args[1:])
   } else if strings.HasPrefix(args[0], "--") {
     mode := args[0][2:]
 
@@ -54,6 +128,20 @@ func mainInner() error {
       return mainBakeInit(args[1:])
     case "project":
       return mainBakeProject(args[1:])
+    case "compdb":
+      return mainMakeMode(mode, args[1:])
+    case "test":
+      return mainMakeTest(args[1:])
+    case "graph":
+      return mainMakeGraph(args[1:])
+    case "watch":
+      return mainMakeWatch(args[1:])
+    case "install":
+      return mainMakeInstall(args[1:])
+    case "cache":
+      return mainBakeCache(args[1:])
+    case "cache-server":
+      return mainBakeCacheServer(args[1:])
     default:
       return errors.New("mode " + mode + " not recognized")
     }
@@ -66,12 +154,14 @@ func mainInner() error {
 
 func mainMake(args []string) error {
   var (
-    force  bool
-    dryRun bool
-    dir    string
+    force     bool
+    dryRun    bool
+    keepGoing bool
+    dir       string
+    jobs      int
   )
 
-  rem, err := ParseGeneralArgsFindMakefile(args, &force, &dryRun, &dir)
+  rem, err := ParseGeneralArgsFindMakefile(args, &force, &dryRun, &keepGoing, &dir, &jobs)
   if err != nil {
     return err
   }
@@ -80,39 +170,76 @@ func mainMake(args []string) error {
     return err
   }
 
-  cmdArgs, err := SetupMakeArgs(dir, force, dryRun)
+  cmdArgs, err := SetupMakeArgs(dir, force, dryRun, keepGoing, jobs)
+  if err != nil {
+    return err
+  }
+
+  return runMake(dir, cmdArgs)
+}
+
+// projects without a Makefile are built directly using their config file
+// the general options are passed via the env variables set by SetupMakeArgs
+func runMake(dir string, cmdArgs []string) error {
+  exists, err := MakefileExists(dir)
   if err != nil {
     return err
   }
 
-  return RunCommand("make", cmdArgs)
+  if exists {
+    return RunCommand("make", cmdArgs)
+  }
+
+  return mainBakeProject([]string{"-C", dir})
 }
 
-// TODO: prompt for user input
-func buildBakeRecipe() string {
+func buildBakeRecipe(a *InitAnswers) string {
   var b strings.Builder
 
-  b.WriteString("PROJECT_TYPE=\"c\"\n")
-  b.WriteString("CPP_DIALECT=\"c++2a\"\n")
-  b.WriteString("COMPILER_CMD=\"clang-11 -std=$(CPP_DIALECT) {include} -c {source} -o {output}\"\n")
-  b.WriteString("LINKER_CMD=\"clang-11 -std=$(CPP_DIALECT) {libs} -o {output} {objects}\"\n")
-  b.WriteString("EMIT_PCH_CMD=\"clang-11 -std=$(CPP_DIALECT) {include} {header} -o {output}\"\n")
-  b.WriteString("INCLUDE_PCH_OPTS=\"-include-pch {pch}\"\n")
-  b.WriteString("DST_DIR=\"./build/\"\n\n")
+  b.WriteString("PROJECT_TYPE=\"" + a.ProjectType + "\"\n")
+
+  if a.ProjectType == "go" {
+    b.WriteString("DST_DIR=\"" + a.DstDir + "\"\n\n")
+    b.WriteString("compile:\n")
+    b.WriteString("\t@bake --project $(PROJECT_TYPE) --dst $(DST_DIR)")
+
+    return b.String()
+  }
+
+  cc := a.Compiler()
+
+  b.WriteString("DIALECT=\"" + a.Dialect + "\"\n")
+  b.WriteString("COMPILER_CMD=\"" + cc + " -std=$(DIALECT) {include} -fPIC -MMD -MF {depfile} -c {source} -o {output}\"\n")
+  b.WriteString("LINKER_CMD=\"" + cc + " -std=$(DIALECT) {libs} -o {output} {objects}\"\n")
+  b.WriteString("LIB_LINKER_CMD=\"" + cc + " -shared {libs} -o {output} {objects}\"\n")
+  b.WriteString("ARCHIVER_CMD=\"ar rcs {output} {objects}\"\n")
+
+  if a.Pch {
+    b.WriteString("EMIT_PCH_CMD=\"" + cc + " -std=$(DIALECT) {include} {header} -o {output}\"\n")
+    b.WriteString("INCLUDE_PCH_OPTS=\"-include-pch {pch}\"\n")
+  }
+
+  b.WriteString("DST_DIR=\"" + a.DstDir + "\"\n\n")
   b.WriteString("compile:\n")
-  b.WriteString("\t@bake --project $(PROJECT_TYPE) --compiler $(COMPILER_CMD) --linker $(LINKER_CMD) --dst $(DST_DIR) --emit-pch $(EMIT_PCH_CMD) --include-pch $(INCLUDE_PCH_OPTS)")
+  b.WriteString("\t@bake --project $(PROJECT_TYPE) --compiler $(COMPILER_CMD) --linker $(LINKER_CMD) --lib-linker $(LIB_LINKER_CMD) --archiver $(ARCHIVER_CMD) --dst $(DST_DIR)")
+
+  if a.Pch {
+    b.WriteString(" --emit-pch $(EMIT_PCH_CMD) --include-pch $(INCLUDE_PCH_OPTS)")
+  }
 
   return b.String()
 }
 
 func mainBakeInit(args []string) error {
   var (
-    force  bool
-    dryRun bool
-    dir    string
+    force     bool
+    dryRun    bool
+    keepGoing bool
+    dir       string
+    jobs      int
   )
 
-  rem, err := ParseGeneralArgsDefaultDirPwd(args, &force, &dryRun, &dir)
+  rem, err := ParseGeneralArgsDefaultDirPwd(args, &force, &dryRun, &keepGoing, &dir, &jobs)
   if err != nil {
     return err
   }
@@ -121,6 +248,9 @@ func mainBakeInit(args []string) error {
     return errors.New("-f/-B and -n are conflicting flags for bake --init")
   }
 
+  yes := false
+  rem = ParseBoolFlags(rem, []string{"--yes", "-y"}, []*bool{&yes, &yes})
+
   if err := AssertNoArgs(rem); err != nil {
     return err
   }
@@ -130,7 +260,12 @@ func mainBakeInit(args []string) error {
     return err
   }
 
-  recipe := buildBakeRecipe()
+  answers, err := NewInitWizard(yes).Run(dir)
+  if err != nil {
+    return err
+  }
+
+  recipe := buildBakeRecipe(answers)
 
   if force || (!dryRun && !exists) {
     if err := WriteMakefile(dir, recipe); err != nil {
@@ -145,12 +280,14 @@ func mainBakeInit(args []string) error {
 
 func mainMakeTarget(target string, args []string) error {
   var (
-    force  bool
-    dryRun bool
-    dir    string
+    force     bool
+    dryRun    bool
+    keepGoing bool
+    dir       string
+    jobs      int
   )
 
-  rem, err := ParseGeneralArgsFindMakefile(args, &force, &dryRun, &dir)
+  rem, err := ParseGeneralArgsFindMakefile(args, &force, &dryRun, &keepGoing, &dir, &jobs)
   if err != nil {
     return err
   }
@@ -159,13 +296,23 @@ func mainMakeTarget(target string, args []string) error {
     return err
   }
 
-  isMakefileTarget, err := TargetExists(dir, target)
+  hasMakefile, err := MakefileExists(dir)
   if err != nil {
     return err
   }
 
-  cmd := "make"
-  cmdArgs, err := SetupMakeArgs(dir, force, dryRun)
+  isMakefileTarget := false
+  if hasMakefile {
+    isMakefileTarget, err = TargetExists(dir, target)
+    if err != nil {
+      return err
+    }
+  }
+
+  cmdArgs, err := SetupMakeArgs(dir, force, dryRun, keepGoing, jobs)
+  if err != nil {
+    return err
+  }
 
   if isMakefileTarget {
     cmdArgs = append(cmdArgs, target)
@@ -175,21 +322,357 @@ func mainMakeTarget(target string, args []string) error {
     }
   }
 
-  return RunCommand(cmd, cmdArgs)
+  return runMake(dir, cmdArgs)
 }
 
-func mainBakeProject(args []string) error {
-  pType := args[0]
+// the mode is passed to the bake project recipe via the BAKE_MODE env variable
+func mainMakeMode(mode string, args []string) error {
+  var (
+    force     bool
+    dryRun    bool
+    keepGoing bool
+    dir       string
+    jobs      int
+  )
+
+  rem, err := ParseGeneralArgsFindMakefile(args, &force, &dryRun, &keepGoing, &dir, &jobs)
+  if err != nil {
+    return err
+  }
+
+  if err := AssertNoArgs(rem); err != nil {
+    return err
+  }
+
+  cmdArgs, err := SetupMakeArgs(dir, force, dryRun, keepGoing, jobs)
+  if err != nil {
+    return err
+  }
+
+  if err := os.Setenv("BAKE_MODE", mode); err != nil {
+    return err
+  }
+
+  return runMake(dir, cmdArgs)
+}
+
+// the junit report path is passed to the bake project recipe via the BAKE_JUNIT env variable, the timeout via BAKE_TEST_TIMEOUT
+func mainMakeTest(args []string) error {
+  junit := ""
+  timeout := ""
+
+  rem, err := ParseStringFlags(args, []string{"--junit", "--timeout"}, []*string{&junit, &timeout})
+  if err != nil {
+    return err
+  }
+
+  if timeout != "" {
+    if _, err := ParseTestTimeout(timeout); err != nil {
+      return err
+    }
+
+    if err := os.Setenv("BAKE_TEST_TIMEOUT", timeout); err != nil {
+      return err
+    }
+  }
+
+  if junit != "" {
+    junit, err = filepath.Abs(junit)
+    if err != nil {
+      return err
+    }
+
+    if err := os.Setenv("BAKE_JUNIT", junit); err != nil {
+      return err
+    }
+  }
+
+  return mainMakeMode("test", rem)
+}
+
+// the format is passed to the bake project recipe via the BAKE_GRAPH env variable, the target via BAKE_TARGET
+func mainMakeGraph(args []string) error {
+  format := GRAPH_DOT
+  if len(args) > 0 && (args[0] == GRAPH_DOT || args[0] == GRAPH_JSON) {
+    format = args[0]
+    args = args[1:]
+  }
+
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    if err := os.Setenv("BAKE_TARGET", args[0]); err != nil {
+      return err
+    }
+
+    args = args[1:]
+  }
+
+  if err := os.Setenv("BAKE_GRAPH", format); err != nil {
+    return err
+  }
+
+  return mainMakeMode("graph", args)
+}
+
+func mainMakeWatch(args []string) error {
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    if err := os.Setenv("BAKE_TARGET", args[0]); err != nil {
+      return err
+    }
+
+    args = args[1:]
+  }
+
+  return mainMakeMode("watch", args)
+}
+
+// the prefix is passed to the bake project recipe via the BAKE_PREFIX env variable
+func mainMakeInstall(args []string) error {
+  prefix := DEFAULT_PREFIX
+
+  rem, err := ParseStringFlags(args, []string{"--prefix"}, []*string{&prefix})
+  if err != nil {
+    return err
+  }
+
+  prefix, err = filepath.Abs(prefix)
+  if err != nil {
+    return err
+  }
+
+  if err := os.Setenv("BAKE_PREFIX", prefix); err != nil {
+    return err
+  }
+
+  // the recipe runs in the project dir, so a relative DESTDIR must be resolved against the cwd of the caller
+  if destDir := os.Getenv("DESTDIR"); destDir != "" {
+    destDir, err = filepath.Abs(destDir)
+    if err != nil {
+      return err
+    }
+
+    if err := os.Setenv("DESTDIR", destDir); err != nil {
+      return err
+    }
+  }
+
+  return mainMakeMode("install", rem)
+}
+
+// the target is built by the bake project recipe, which writes the path of the exe to BAKE_RUN_PATH_FILE
+// args after `--` are passed to the exe, the exit code of the exe becomes the exit code of bake
+func mainRun(args []string) error {
+  if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+    return errors.New("run expects a target")
+  }
+
+  target := args[0]
   args = args[1:]
 
+  exeArgs := []string{}
+  if i := FindString(args, "--"); i > -1 {
+    exeArgs = args[i+1:]
+    args = args[0:i]
+  }
+
+  pathFile, err := ioutil.TempFile("", "bake-run-")
+  if err != nil {
+    return err
+  }
+
+  pathFile.Close()
+
+  defer os.Remove(pathFile.Name())
+
+  if err := os.Setenv("BAKE_TARGET", target); err != nil {
+    return err
+  }
+
+  if err := os.Setenv("BAKE_RUN_PATH_FILE", pathFile.Name()); err != nil {
+    return err
+  }
+
+  if err := mainMakeMode("run", args); err != nil {
+    return errors.New("build of " + target + " failed, not running it (" + err.Error() + ")")
+  }
+
+  b, err := ioutil.ReadFile(pathFile.Name())
+  if err != nil {
+    return err
+  }
+
+  exePath := string(b)
+  if exePath == "" {
+    return errors.New("path of " + target + " unknown")
+  }
+
+  if os.Getenv("BAKE_DRYRUN") != "" {
+    fmt.Println(strings.Join(append([]string{exePath}, exeArgs...), " "))
+    return nil
+  }
+
+  if err := RunCommand(exePath, exeArgs); err != nil {
+    // killed by a signal
+    if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+      return &ExitCodeError{exitErr.ExitCode()}
+    }
+
+    return err
+  }
+
+  return nil
+}
+
+func mainBakeCache(args []string) error {
+  if len(args) == 0 {
+    return errors.New("--cache expects a command (stats, prune, verify or clear)")
+  }
+
+  cmd := args[0]
+
+  var (
+    force     bool
+    dryRun    bool
+    keepGoing bool
+    dir       string
+    jobs      int
+    maxAgeStr  string
+    maxSizeStr string
+    orphans    bool
+    fix        bool
+    all        bool
+  )
+
+  rem, err := ParseGeneralArgs(args[1:], &force, &dryRun, &keepGoing, &dir, &jobs)
+  if err != nil {
+    return err
+  }
+
+  rem = ParseBoolFlags(rem, []string{"--orphans", "--fix", "--all"}, []*bool{&orphans, &fix, &all})
+
+  rem, err = ParseStringFlags(rem, []string{"--max-age", "--max-size"}, []*string{&maxAgeStr, &maxSizeStr})
+  if err != nil {
+    return err
+  }
+
+  if err := AssertNoArgs(rem); err != nil {
+    return err
+  }
+
+  if err := InitCacheDir(); err != nil {
+    return err
+  }
+
+  entries, err := ListCacheEntries(CACHE_DIR)
+  if err != nil {
+    return err
+  }
+
+  switch cmd {
+  case "stats":
+    CacheStats(entries)
+    return nil
+  case "prune":
+    var maxAge time.Duration
+    if maxAgeStr != "" {
+      maxAge, err = ParseAge(maxAgeStr)
+      if err != nil {
+        return err
+      }
+    }
+
+    maxSize := int64(-1)
+    if maxSizeStr != "" {
+      maxSize, err = ParseSize(maxSizeStr)
+      if err != nil {
+        return err
+      }
+    }
+
+    if maxAge == 0 && maxSize < 0 && !orphans {
+      return errors.New("--cache prune expects at least one of --max-age, --max-size or --orphans")
+    }
+
+    return CachePrune(entries, maxAge, maxSize, orphans, dryRun)
+  case "verify":
+    return CacheVerify(CACHE_DIR, entries, fix, dryRun)
+  case "clear":
+    root := ""
+    if !all {
+      if dir == "" {
+        dir, err = FindMakefileDir()
+        if err != nil {
+          return err
+        }
+      }
+
+      root = dir
+    }
+
+    return CacheClear(entries, root, dryRun)
+  default:
+    return errors.New("unrecognized --cache command " + cmd)
+  }
+}
+
+func mainBakeCacheServer(args []string) error {
+  if len(args) == 0 {
+    return errors.New("--cache-server expects a directory")
+  }
+
+  dir, err := filepath.Abs(args[0])
+  if err != nil {
+    return err
+  }
+
+  addr := "localhost:8080"
+
+  rem, err := ParseStringFlags(args[1:], []string{"--listen"}, []*string{&addr})
+  if err != nil {
+    return err
+  }
+
+  if err := AssertNoArgs(rem); err != nil {
+    return err
+  }
+
+  return ServeRemoteStore(dir, addr)
+}
+
+// the project type can be omitted if the project root contains a config file
+func mainBakeProject(args []string) error {
+  pType := ""
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    pType = args[0]
+    args = args[1:]
+  } else {
+    dir := ""
+    if _, err := ParseStringFlags(args, []string{"-C"}, []*string{&dir}); err != nil {
+      return err
+    }
+
+    cfg, err := ReadConfig(dir)
+    if err != nil {
+      return err
+    }
+
+    pType = cfg.Project
+    if pType == "" {
+      return errors.New("--project expects a type (c or go)")
+    }
+  }
+
   var project Project
   var err error
 
+  if err := InitCacheDir(); err != nil {
+    return err
+  }
+
   switch pType {
   case "c":
     project, err = NewCProject(args)
-  //case "go":
-    //project, err = NewGoProject(args)
+  case "go":
+    project, err = NewGoProject(args)
   default:
     return errors.New("unrecognized project type " + pType)
   }
@@ -198,18 +681,40 @@ func mainBakeProject(args []string) error {
     return err
   }
 
-  home := os.Getenv("HOME")
-  CACHE_DIR = filepath.Join(home, CACHE_DIR_REL)
-  if err := os.MkdirAll(CACHE_DIR, 0755); err != nil {
-    return err
-  }
-
   if err := project.ResolveDeps(); err != nil {
     return err
   }
 
+  bakeMode := os.Getenv("BAKE_MODE")
   bakeTarget := os.Getenv("BAKE_TARGET")
 
+  switch bakeMode {
+  case "":
+  case "compdb":
+    return project.WriteCompDB()
+  case "test":
+    return project.Test()
+  case "graph":
+    return project.WriteGraph(os.Getenv("BAKE_GRAPH"), bakeTarget)
+  case "watch":
+    return project.Watch(bakeTarget)
+  case "install":
+    return project.Install(os.Getenv("BAKE_PREFIX"))
+  case "run":
+    exePath, err := project.TargetExePath(bakeTarget)
+    if err != nil {
+      return err
+    }
+
+    if err := project.BuildTarget(bakeTarget); err != nil {
+      return err
+    }
+
+    return ioutil.WriteFile(os.Getenv("BAKE_RUN_PATH_FILE"), []byte(exePath), 0644)
+  default:
+    return errors.New("unrecognized bake mode " + bakeMode)
+  }
+
   if bakeTarget != "" {
     return project.BuildTarget(bakeTarget)
   } else {
@@ -7,6 +7,7 @@ import (
   "os"
   "os/exec"
   "path/filepath"
+  "strconv"
   "strings"
 )
 
@@ -14,6 +15,7 @@ const (
   MAKEFILE = "Makefile"
 )
 
+// a dir containing a config file also counts, as such projects can be built without a Makefile
 func FindMakefileDir() (string, error) {
   curDir, err := os.Getwd()
   if err != nil {
@@ -34,12 +36,19 @@ func FindMakefileDir() (string, error) {
       break
     }
 
+    if exists, err := ConfigExists(curDir); err != nil {
+      return "", err
+    } else if exists {
+      found = true
+      break
+    }
+
     // move up one
     curDir = filepath.Dir(curDir)
   }
 
   if !found {
-    return "", errors.New(MAKEFILE + " not found")
+    return "", errors.New(MAKEFILE + ", " + CONFIG_TOML + " or " + CONFIG_JSON + " not found")
   } 
 
   return curDir, nil
@@ -84,7 +93,7 @@ func TargetExists(dir string, target string) (bool, error) {
   }
 }
 
-func SetupMakeArgs(dir string, force bool, dryRun bool) ([]string, error) {
+func SetupMakeArgs(dir string, force bool, dryRun bool, keepGoing bool, jobs int) ([]string, error) {
   if os.Getenv("MAKELEVEL") != "" {
     return nil, errors.New("can't be called inside make")
   }
@@ -96,8 +105,9 @@ func SetupMakeArgs(dir string, force bool, dryRun bool) ([]string, error) {
     return nil, err
   }
 
+  // without --no-print-directory make writes "Entering directory" lines to stdout, which would corrupt e.g. the output of --graph
   if pwd != dir {
-    cmdArgs = append(cmdArgs, "-C", dir)
+    cmdArgs = append(cmdArgs, "-C", dir, "--no-print-directory")
   }
 
   if force {
@@ -116,6 +126,20 @@ func SetupMakeArgs(dir string, force bool, dryRun bool) ([]string, error) {
     }
   }
 
+  if keepGoing {
+    cmdArgs = append(cmdArgs, "-k")
+
+    if err := os.Setenv("BAKE_KEEP_GOING", "true"); err != nil {
+      return nil, err
+    }
+  }
+
+  if jobs > 0 {
+    if err := os.Setenv("BAKE_JOBS", strconv.Itoa(jobs)); err != nil {
+      return nil, err
+    }
+  }
+
   return cmdArgs, nil
 }
 
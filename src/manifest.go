@@ -0,0 +1,241 @@
+package main
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  MANIFEST_EXT = ".manifest"
+)
+
+// content hashes of the files used to create a cached dst (object or pch), and the signature of the command that created it
+// the project root and source are recorded so that cache entries can be attributed to projects and sources
+type Manifest struct {
+  Root      string
+  Source    string
+  Signature string
+  Entries   map[string]ManifestEntry
+}
+
+type ManifestEntry struct {
+  Hash    string
+  ModTime time.Time
+}
+
+func ManifestPath(dst string) string {
+  return dst + MANIFEST_EXT
+}
+
+func NewManifest(root string, source string, signature string, files []*File) (*Manifest, error) {
+  m := &Manifest{root, source, signature, make(map[string]ManifestEntry)}
+
+  for _, f := range files {
+    hash, err := f.Hash()
+    if err != nil {
+      return nil, err
+    }
+
+    m.Entries[f.Path] = ManifestEntry{hash, f.ModTime}
+  }
+
+  return m, nil
+}
+
+// format: a `root <root>` line, a `source <source>` line, a `signature <signature>` line, followed by one `<hash> <mod-time-unix-nano> <path>` line per file
+func ReadManifest(dst string) (*Manifest, error) {
+  b, err := ioutil.ReadFile(ManifestPath(dst))
+  if err != nil {
+    return nil, err
+  }
+
+  m := &Manifest{"", "", "", make(map[string]ManifestEntry)}
+
+  for _, line := range strings.Split(string(b), "\n") {
+    if line == "" {
+      continue
+    } else if strings.HasPrefix(line, "root ") {
+      m.Root = strings.TrimPrefix(line, "root ")
+      continue
+    } else if strings.HasPrefix(line, "source ") {
+      m.Source = strings.TrimPrefix(line, "source ")
+      continue
+    } else if strings.HasPrefix(line, "signature ") {
+      m.Signature = strings.TrimPrefix(line, "signature ")
+      continue
+    }
+
+    fs := strings.SplitN(line, " ", 3)
+    if len(fs) != 3 {
+      return nil, errors.New("invalid manifest line in " + ManifestPath(dst))
+    }
+
+    nanos, err := strconv.ParseInt(fs[1], 10, 64)
+    if err != nil {
+      return nil, err
+    }
+
+    m.Entries[fs[2]] = ManifestEntry{fs[0], time.Unix(0, nanos)}
+  }
+
+  return m, nil
+}
+
+func (m *Manifest) Write(dst string) error {
+  var b strings.Builder
+
+  b.WriteString("root ")
+  b.WriteString(m.Root)
+  b.WriteString("\n")
+  b.WriteString("source ")
+  b.WriteString(m.Source)
+  b.WriteString("\n")
+  b.WriteString("signature ")
+  b.WriteString(m.Signature)
+  b.WriteString("\n")
+
+  for path, entry := range m.Entries {
+    b.WriteString(entry.Hash)
+    b.WriteString(" ")
+    b.WriteString(strconv.FormatInt(entry.ModTime.UnixNano(), 10))
+    b.WriteString(" ")
+    b.WriteString(path)
+    b.WriteString("\n")
+  }
+
+  return WriteFileAtomic(ManifestPath(dst), []byte(b.String()))
+}
+
+// the hashes are cached, so that they can be calculated before running a command, and recorded afterwards
+func HashFiles(files []*File) error {
+  for _, f := range files {
+    if _, err := f.Hash(); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func RemoveManifest(dst string) error {
+  if err := os.Remove(ManifestPath(dst)); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  return nil
+}
+
+// returns nil if the manifest is still valid
+// the bool return value is true if the manifest is still valid but some of the mod times have changed
+func (m *Manifest) Compare(signature string, files []*File) (*Reason, bool) {
+  if signature != m.Signature {
+    return NewReason(REASON_COMMAND, ""), false
+  }
+
+  modTimesChanged := false
+
+  for _, f := range files {
+    entry, ok := m.Entries[f.Path]
+    if !ok {
+      return NewReason(REASON_ADDED, f.Path), false
+    }
+
+    if entry.ModTime.Equal(f.ModTime) {
+      continue
+    }
+
+    hash, err := f.Hash()
+    if err != nil || hash != entry.Hash {
+      return NewReason(REASON_CHANGED, f.Path), false
+    }
+
+    modTimesChanged = true
+  }
+
+  if len(files) != len(m.Entries) {
+    for path := range m.Entries {
+      if len(FilterFiles(files, func(f *File) bool { return f.Path == path })) == 0 {
+        return NewReason(REASON_REMOVED, path), false
+      }
+    }
+  }
+
+  return nil, modTimesChanged
+}
+
+// dst is up-to-date if it exists, if the command signature is unchanged, and if the content hashes of f and all its dependencies are unchanged
+// returns nil if dst is up-to-date
+func ContentOutdated(f *File, dst string, signature string, dryRun bool) *Reason {
+  return contentOutdated(dst, signature, dryRun, func(m *Manifest) ([]*File, error) {
+    return f.ListDeepDeps(), nil
+  })
+}
+
+// same as ContentOutdated, but the dependencies are the ones recorded in the manifest (e.g. taken from a depfile)
+func RecordedContentOutdated(dst string, signature string, dryRun bool, lookup func(path string) (*File, error)) *Reason {
+  return contentOutdated(dst, signature, dryRun, func(m *Manifest) ([]*File, error) {
+    files := make([]*File, 0)
+
+    for path := range m.Entries {
+      f, err := lookup(path)
+      if err != nil {
+        return nil, err
+      }
+
+      files = append(files, f)
+    }
+
+    return files, nil
+  })
+}
+
+func contentOutdated(dst string, signature string, dryRun bool, listFiles func(m *Manifest) ([]*File, error)) *Reason {
+  if _, err := os.Stat(dst); err != nil {
+    return NewReason(REASON_MISSING, "")
+  }
+
+  m, err := ReadManifest(dst)
+  if err != nil {
+    return NewReason(REASON_MANIFEST, "")
+  }
+
+  files, err := listFiles(m)
+  if err != nil {
+    return NewReason(REASON_ERROR, err.Error())
+  }
+
+  reason, modTimesChanged := m.Compare(signature, files)
+  isUpToDate := reason == nil
+
+  // refresh the mod times so the files don't need to be hashed again next time
+  // otherwise touch the manifest, so that `bake --cache prune` knows when the entry was last used
+  if isUpToDate && !dryRun {
+    if modTimesChanged {
+      if newM, err := NewManifest(m.Root, m.Source, signature, files); err == nil {
+        newM.Write(dst)
+      }
+    } else {
+      now := time.Now()
+      os.Chtimes(ManifestPath(dst), now, now)
+    }
+  }
+
+  return reason
+}
+
+func WriteContentManifest(f *File, dst string, root string, signature string) error {
+  return WriteRecordedManifest(dst, root, f.Path, signature, f.ListDeepDeps())
+}
+
+func WriteRecordedManifest(dst string, root string, source string, signature string, files []*File) error {
+  m, err := NewManifest(root, source, signature, files)
+  if err != nil {
+    return err
+  }
+
+  return m.Write(dst)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "errors"
+  "os"
+  "os/exec"
+  "strings"
+  "sync"
+)
+
+const (
+  PKG_HEAD_PAT = "//! pkg "
+  PKG_PREFIX   = "pkg:" // lib map args with this prefix are pkg-config packages
+)
+
+// runs pkg-config (or $PKG_CONFIG), results are cached because the same queries are repeated for many files
+// packages are searched in PKG_CONFIG_PATH as usual
+type PkgConfig struct {
+  cmd   string
+  cache map[string]string
+  mutex *sync.Mutex
+}
+
+func NewPkgConfig() *PkgConfig {
+  cmd := os.Getenv("PKG_CONFIG")
+  if cmd == "" {
+    cmd = "pkg-config"
+  }
+
+  return &PkgConfig{cmd, make(map[string]string), &sync.Mutex{}}
+}
+
+// flag is --cflags or --libs
+func (pc *PkgConfig) Query(flag string, pkgs []string) (string, error) {
+  if len(pkgs) == 0 {
+    return "", nil
+  }
+
+  key := flag + " " + strings.Join(pkgs, " ")
+
+  pc.mutex.Lock()
+
+  defer pc.mutex.Unlock()
+
+  if res, ok := pc.cache[key]; ok {
+    return res, nil
+  }
+
+  out, err := exec.Command(pc.cmd, append([]string{flag}, pkgs...)...).Output()
+  if err != nil {
+    msg := err.Error()
+    if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+      msg = strings.TrimSpace(string(exitErr.Stderr))
+    }
+
+    return "", errors.New(pc.cmd + " " + key + ": " + msg)
+  }
+
+  res := strings.Join(strings.Fields(string(out)), " ")
+
+  pc.cache[key] = res
+
+  return res, nil
+}
+
+// `//! pkg <name>...` lines, anywhere in the file (so they can be combined with other heads)
+func ScanPkgHeads(b []byte) []string {
+  pkgs := make([]string, 0)
+
+  for _, line := range strings.Split(string(b), "\n") {
+    line = strings.TrimSpace(line)
+
+    if strings.HasPrefix(line, PKG_HEAD_PAT) {
+      pkgs = append(pkgs, strings.Fields(strings.TrimPrefix(line, PKG_HEAD_PAT))...)
+    }
+  }
+
+  return pkgs
+}
+
+// packages of a translation unit: from the pkg heads of f and its (indirect) deps, and from the lib map
+func (p *CProject) ListObjPkgs(f *File) []string {
+  pkgs := make([]string, 0)
+
+  for _, dep := range f.ListDeepDeps() {
+    pkgs = append(pkgs, dep.Pkgs...)
+  }
+
+  _, _, mapped := p.libMap.Resolve(f.ListDeepRawDeps())
+
+  return SortUnique(append(pkgs, mapped...))
+}
+
+func (p *CProject) ListLinkPkgs(objFiles []*File) []string {
+  pkgs := make([]string, 0)
+
+  for _, fObj := range objFiles {
+    pkgs = append(pkgs, p.ListObjPkgs(fObj)...)
+  }
+
+  return SortUnique(pkgs)
+}
+
+// the value of the {libs} placeholder of linker commands
+func (p *CProject) linkLibOpts(libs []string, flags []string, objFiles []*File) (string, error) {
+  libOpts := formatLibOpts(libs, flags)
+
+  pkgLibs, err := p.pkgConfig.Query("--libs", p.ListLinkPkgs(objFiles))
+  if err != nil {
+    return "", err
+  }
+
+  if pkgLibs != "" {
+    libOpts = strings.TrimSpace(libOpts + " " + pkgLibs)
+  }
+
+  return libOpts, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "os"
+  "os/exec"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+func withPkgConfigPath(t *testing.T, fn func(dir string)) {
+  if _, err := exec.LookPath("pkg-config"); err != nil {
+    t.Skip("pkg-config not found")
+  }
+
+  dir, err := filepath.Abs(filepath.Join("testdata", "pkgconfig"))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  prev, hadPrev := os.LookupEnv("PKG_CONFIG_PATH")
+  os.Setenv("PKG_CONFIG_PATH", dir)
+
+  defer func() {
+    if hadPrev {
+      os.Setenv("PKG_CONFIG_PATH", prev)
+    } else {
+      os.Unsetenv("PKG_CONFIG_PATH")
+    }
+  }()
+
+  fn(dir)
+}
+
+func TestPkgConfigQuery(t *testing.T) {
+  withPkgConfigPath(t, func(dir string) {
+    pc := NewPkgConfig()
+
+    cflags, err := pc.Query("--cflags", []string{"greet"})
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if expected := "-I" + dir + "/include -DGREET=1"; cflags != expected {
+      t.Errorf("expected cflags %q, got %q", expected, cflags)
+    }
+
+    libs, err := pc.Query("--libs", []string{"greet"})
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if expected := "-L" + dir + "/lib -lgreet"; libs != expected {
+      t.Errorf("expected libs %q, got %q", expected, libs)
+    }
+
+    if _, err := pc.Query("--cflags", []string{"doesnt-exist"}); err == nil {
+      t.Error("expected an error for a missing package")
+    }
+
+    if res, err := pc.Query("--libs", []string{}); err != nil || res != "" {
+      t.Errorf("expected no libs without packages, got %q (%v)", res, err)
+    }
+  })
+}
+
+func TestScanPkgHeads(t *testing.T) {
+  src := "//! lib foo\n//! pkg greet zlib\n#include <stdio.h>\n  //! pkg gtk+-3.0\n// ! pkg not-a-head\n"
+
+  if pkgs, expected := ScanPkgHeads([]byte(src)), []string{"greet", "zlib", "gtk+-3.0"}; !reflect.DeepEqual(pkgs, expected) {
+    t.Errorf("expected %v, got %v", expected, pkgs)
+  }
+}
+
+func TestLibMapPkgs(t *testing.T) {
+  m := DefaultLibMap()
+  m.Set("<greet/*>", []string{"pkg:greet", "-rdynamic", "extra"})
+
+  libs, flags, pkgs := m.Resolve([]string{"<greet/greet.h>", "<math.h>", "\"greet/local.h\""})
+
+  if expected := []string{"m", "extra"}; !reflect.DeepEqual(libs, expected) {
+    t.Errorf("expected libs %v, got %v", expected, libs)
+  }
+
+  if expected := []string{"-rdynamic"}; !reflect.DeepEqual(flags, expected) {
+    t.Errorf("expected flags %v, got %v", expected, flags)
+  }
+
+  if expected := []string{"greet"}; !reflect.DeepEqual(pkgs, expected) {
+    t.Errorf("expected pkgs %v, got %v", expected, pkgs)
+  }
+}
@@ -2,10 +2,11 @@ package main
 
 import (
   "errors"
-  "io/ioutil"
+  "fmt"
   "os"
   "path/filepath"
   "regexp"
+  "strconv"
   "strings"
   "sync"
 )
@@ -15,32 +16,66 @@ type Project interface {
 
   Build() error
   BuildTarget(target string) error
-}
+  TargetExePath(target string) (string, error)
 
-type ProjectData struct {
-  force   bool
-  dryRun  bool
-  root    string
-  dstDir  string
+  WriteCompDB() error
+  WriteGraph(format string, target string) error
 
-  files   []*File
+  Test() error
+  Watch(target string) error
+  Install(prefix string) error
+}
 
-  mutex   *sync.RWMutex
+type ProjectData struct {
+  force     bool
+  dryRun    bool
+  keepGoing bool
+  root      string
+  dstDir    string
+  jobs      int // 0 -> number of cpus
+  profile   string // empty for the default profile
+  why       bool // print the reason for every rebuild
+  config    ConfigOptions // from the config file, for the active profile
+  walker    *Walker // source discovery
+
+  files     []*File
+
+  mutex     *sync.RWMutex
 }
 
 func (p *ProjectData) InitProject(args []string) ([]string, error) {
-  rem, err := ParseGeneralArgsDefaultDirPwd(args, &p.force, &p.dryRun, &p.root)
+  rem, err := ParseGeneralArgsDefaultDirPwd(args, &p.force, &p.dryRun, &p.keepGoing, &p.root, &p.jobs)
+  if err != nil {
+    return nil, err
+  }
+
+  p.profile = os.Getenv("BAKE_PROFILE")
+  if err := AssertValidProfile(p.profile); err != nil {
+    return nil, err
+  }
+
+  cfg, err := ReadConfig(p.root)
+  if err != nil {
+    return nil, err
+  }
+
+  p.config, err = cfg.Options(p.profile)
   if err != nil {
     return nil, err
   }
 
-  dstDir := ""
+  dstDir := p.config.Dst
 
   rem, err = ParseStringFlags(rem, []string{"--dst"}, []*string{&dstDir})
   if err != nil {
     return nil, err
   }
 
+  rem, err = ParseProfileFlags(rem, p.profile, []string{"--dst"}, []*string{&dstDir})
+  if err != nil {
+    return nil, err
+  }
+
   if dstDir == "" {
     return nil, errors.New("--dst not specified")
   }
@@ -54,7 +89,24 @@ func (p *ProjectData) InitProject(args []string) ([]string, error) {
   }
 
   p.dstDir = dstDir
-  
+
+  // the globs of the command line are added to those of the config
+  include := append([]string{}, p.config.Include...)
+  exclude := append([]string{}, p.config.Exclude...)
+  followSymlinks := p.config.FollowSymlinks
+
+  rem, err = ParseStringListFlags(rem, []string{"--include", "--exclude"}, []*[]string{&include, &exclude})
+  if err != nil {
+    return nil, err
+  }
+
+  rem = ParseBoolFlags(rem, []string{"--follow-symlinks"}, []*bool{&followSymlinks})
+
+  p.walker, err = NewWalker(p.root, WalkOptions{include, exclude, followSymlinks, []string{dstDir}})
+  if err != nil {
+    return nil, err
+  }
+
   if p.mutex == nil {
     p.mutex = &sync.RWMutex{}
   }
@@ -67,33 +119,35 @@ func (p *ProjectData) InitProject(args []string) ([]string, error) {
     p.dryRun = true
   }
 
+  if os.Getenv("BAKE_KEEP_GOING") != "" {
+    p.keepGoing = true
+  }
+
+  if os.Getenv("BAKE_WHY") != "" {
+    p.why = true
+  }
+
+  if jobs := os.Getenv("BAKE_JOBS"); jobs != "" && p.jobs == 0 {
+    p.jobs, err = strconv.Atoi(jobs)
+    if err != nil {
+      return nil, errors.New("invalid BAKE_JOBS " + jobs)
+    }
+  }
+
   return rem, nil
 }
 
-func WalkFiles(dir string, fn func(path string, info os.FileInfo) error) error {
-  infos, err := ioutil.ReadDir(dir)
-  if err != nil {
-    return err
-  }
-
-  for _, info := range infos {
-    path := filepath.Join(dir, info.Name())
-    if info.IsDir() {
-      if err := WalkFiles(path, fn); err != nil {
-        return err
-      }
-    } else {
-      if err := fn(path, info); err != nil {
-        return err
-      }
-    }
+// objects of different profiles are cached separately, so switching profiles doesn't require rebuilding everything
+func (p *ProjectData) CacheDir() string {
+  if p.profile == "" {
+    return CACHE_DIR
   }
 
-  return nil
+  return filepath.Join(CACHE_DIR, PROFILES_DIR_REL, p.profile)
 }
 
 func (p *ProjectData) WalkFiles(fn func(path string, info os.FileInfo) error) error {
-  return WalkFiles(p.root, fn)
+  return p.walker.Walk(fn)
 }
 
 func FillTemplate(tmp string, args map[string]string, ctx string) (string, error) {
@@ -119,6 +173,10 @@ func FillTemplate(tmp string, args map[string]string, ctx string) (string, error
   return tmp, nil
 }
 
+func (p *ProjectData) NewScheduler() *Scheduler {
+  return NewScheduler(p.jobs, p.keepGoing)
+}
+
 func (p *ProjectData) FindFile(path string) *File {
   for _, f := range p.files {
     if f.Path == path {
@@ -129,6 +187,20 @@ func (p *ProjectData) FindFile(path string) *File {
   return nil
 }
 
+// files outside the project (e.g. system headers listed in depfiles) are stat'ed directly
+func (p *ProjectData) LookupFile(path string) (*File, error) {
+  if f := p.FindFile(path); f != nil {
+    return f, nil
+  }
+
+  stat, err := os.Stat(path)
+  if err != nil {
+    return nil, err
+  }
+
+  return NewFile(path, stat.ModTime(), "", []string{}, false), nil
+}
+
 func (p *ProjectData) FindFileBySuffix(suffix string) *File {
   for _, f := range p.files {
     if strings.HasSuffix(f.Path, suffix) {
@@ -146,3 +218,37 @@ func (p *ProjectData) FilterFiles(fn func(f *File) bool) []*File {
 func (p *ProjectData) PrintCommand(cmdName string, cmdArgs []string) {
   PrintCommand(p.root, CACHE_DIR, cmdName, cmdArgs)
 }
+
+// outdated is only called if the build isn't forced
+// in --why mode the reason is printed, kind and dst identify what is being rebuilt
+func (p *ProjectData) NeedsRebuild(kind string, dst string, outdated func() *Reason) bool {
+  var reason *Reason
+  if p.force {
+    reason = NewReason(REASON_FORCED, "")
+  } else {
+    reason = outdated()
+  }
+
+  if reason != nil && p.why {
+    fmt.Printf("why %s %s: %s\n", kind, p.FormatPath(dst), reason.Format(p.FormatPath))
+  }
+
+  return reason != nil
+}
+
+func (p *ProjectData) FormatPath(path string) string {
+  if strings.HasPrefix(path, p.root) {
+    return "." + strings.TrimPrefix(path, p.root)
+  }
+
+  return path
+}
+
+// wraps err so that the failed command can be listed in the summary of keep-going builds
+func (p *ProjectData) CommandError(cmdName string, cmdArgs []string, err error) error {
+  if err == nil {
+    return nil
+  }
+
+  return &CommandError{FormatCommand(p.root, CACHE_DIR, cmdName, cmdArgs), err}
+}
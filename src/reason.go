@@ -0,0 +1,55 @@
+package main
+
+const (
+  REASON_MISSING    = "missing"
+  REASON_FORCED     = "forced"
+  REASON_COMMAND    = "command"
+  REASON_MANIFEST   = "manifest"
+  REASON_CHANGED    = "changed"
+  REASON_NEWER      = "newer"
+  REASON_ADDED      = "added"
+  REASON_REMOVED    = "removed"
+  REASON_RECOMPILED = "recompiled"
+  REASON_ERROR      = "error"
+)
+
+// why a dst must be (re)built, a nil reason means the dst is up-to-date
+type Reason struct {
+  Kind string
+  Path string // the responsible file (if any), or the error message for REASON_ERROR
+}
+
+func NewReason(kind string, path string) *Reason {
+  return &Reason{kind, path}
+}
+
+func (r *Reason) Format(formatPath func(path string) string) string {
+  switch r.Kind {
+  case REASON_MISSING:
+    return "doesn't exist yet"
+  case REASON_FORCED:
+    return "forced (-f/-B)"
+  case REASON_COMMAND:
+    return "command or compiler changed"
+  case REASON_MANIFEST:
+    return "manifest is missing or invalid"
+  case REASON_CHANGED:
+    return formatPath(r.Path) + " changed"
+  case REASON_NEWER:
+    return formatPath(r.Path) + " is newer"
+  case REASON_ADDED:
+    return formatPath(r.Path) + " is a new dependency"
+  case REASON_REMOVED:
+    return formatPath(r.Path) + " is no longer a dependency"
+  case REASON_RECOMPILED:
+    return formatPath(r.Path) + " was recompiled"
+  default:
+    return r.Path
+  }
+}
+
+func (r *Reason) String() string {
+  return r.Format(func(path string) string {
+    return path
+  })
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The remote store mirrors the layout of the local object store: `GET/PUT <url>/objects/<key>` and
+// `GET/PUT <url>/manifests/<key>`. The local store acts as a read-through cache.
+// PCHs aren't shared, because they embed abs paths and mod times of the headers.
+
+const (
+  REMOTE_TIMEOUT  = 10*time.Second
+  REMOTE_MAX_SIZE = 1 << 30
+)
+
+var (
+  REMOTE_KEY_RE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+type RemoteStore struct {
+  url      string
+  readOnly bool
+  client   *http.Client
+
+  mutex    *sync.Mutex
+  offline  bool // set after the first connection failure, so the build isn't slowed down by repeated timeouts
+}
+
+func NewRemoteStore(url string, readOnly bool) *RemoteStore {
+  return &RemoteStore{
+    url:      strings.TrimRight(url, "/"),
+    readOnly: readOnly,
+    client:   &http.Client{Timeout: REMOTE_TIMEOUT},
+    mutex:    &sync.Mutex{},
+    offline:  false,
+  }
+}
+
+func (r *RemoteStore) isOffline() bool {
+  r.mutex.Lock()
+
+  defer r.mutex.Unlock()
+
+  return r.offline
+}
+
+func (r *RemoteStore) goOffline(err error) {
+  r.mutex.Lock()
+
+  defer r.mutex.Unlock()
+
+  if !r.offline {
+    fmt.Fprintf(os.Stderr, "remote cache %s unreachable, building locally (%s)\n", r.url, err.Error())
+    r.offline = true
+  }
+}
+
+// returns nil content if the key doesn't exist, content larger than REMOTE_MAX_SIZE is an error
+func (r *RemoteStore) get(kind string, key string) ([]byte, error) {
+  if r.isOffline() {
+    return nil, nil
+  }
+
+  resp, err := r.client.Get(r.url + "/" + kind + "/" + key)
+  if err != nil {
+    r.goOffline(err)
+    return nil, nil
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode == http.StatusNotFound {
+    return nil, nil
+  } else if resp.StatusCode != http.StatusOK {
+    return nil, errors.New("remote cache GET " + kind + "/" + key + ": " + resp.Status)
+  }
+
+  tooLarge := errors.New("remote cache GET " + kind + "/" + key + ": larger than " + strconv.Itoa(REMOTE_MAX_SIZE) + " bytes")
+
+  if resp.ContentLength > REMOTE_MAX_SIZE {
+    return nil, tooLarge
+  }
+
+  content, err := ioutil.ReadAll(io.LimitReader(resp.Body, REMOTE_MAX_SIZE + 1))
+  if err != nil {
+    return nil, err
+  }
+
+  if len(content) > REMOTE_MAX_SIZE {
+    return nil, tooLarge
+  } else if resp.ContentLength >= 0 && int64(len(content)) != resp.ContentLength {
+    return nil, errors.New("remote cache GET " + kind + "/" + key + ": truncated")
+  }
+
+  return content, nil
+}
+
+func (r *RemoteStore) exists(kind string, key string) (bool, error) {
+  if r.isOffline() {
+    return false, nil
+  }
+
+  resp, err := r.client.Head(r.url + "/" + kind + "/" + key)
+  if err != nil {
+    r.goOffline(err)
+    return false, nil
+  }
+
+  resp.Body.Close()
+
+  if resp.StatusCode == http.StatusNotFound {
+    return false, nil
+  } else if resp.StatusCode != http.StatusOK {
+    return false, errors.New("remote cache HEAD " + kind + "/" + key + ": " + resp.Status)
+  }
+
+  return true, nil
+}
+
+func (r *RemoteStore) put(kind string, key string, content []byte) error {
+  if r.readOnly || r.isOffline() {
+    return nil
+  }
+
+  req, err := http.NewRequest(http.MethodPut, r.url + "/" + kind + "/" + key, bytes.NewReader(content))
+  if err != nil {
+    return err
+  }
+
+  resp, err := r.client.Do(req)
+  if err != nil {
+    r.goOffline(err)
+    return nil
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+    return errors.New("remote cache PUT " + kind + "/" + key + ": " + resp.Status)
+  }
+
+  return nil
+}
+
+// merges the remote candidates into the local store manifest
+func (r *RemoteStore) FetchManifest(key string) error {
+  content, err := r.get(STORE_MANIFESTS_REL, key)
+  if err != nil || content == nil {
+    return err
+  }
+
+  remote, err := ParseStoreManifest(content)
+  if err != nil {
+    return err
+  }
+
+  local, err := ReadStoreManifest(key)
+  if err != nil {
+    return err
+  }
+
+  return WriteStoreManifest(key, MergeStoreCandidates(local, remote))
+}
+
+// returns false if the object doesn't exist remotely
+// objects are only stored if their content matches the digest of the manifest candidate
+func (r *RemoteStore) FetchObject(key string, digest string) (bool, error) {
+  if digest == "" {
+    return false, nil
+  }
+
+  content, err := r.get(STORE_OBJECTS_REL, key)
+  if err != nil || content == nil {
+    return false, err
+  }
+
+  if HashBytes(content) != digest {
+    return false, errors.New("remote cache object " + key + " doesn't match its digest")
+  }
+
+  if err := WriteFileAtomic(StoreObjectPath(key), content); err != nil {
+    return false, err
+  }
+
+  return true, nil
+}
+
+// returns true if the object was uploaded, objects that already exist remotely are skipped
+func (r *RemoteStore) PutObject(key string) (bool, error) {
+  if r.readOnly || r.isOffline() {
+    return false, nil
+  }
+
+  exists, err := r.exists(STORE_OBJECTS_REL, key)
+  if err != nil || exists {
+    return false, err
+  }
+
+  content, err := ioutil.ReadFile(StoreObjectPath(key))
+  if err != nil {
+    return false, err
+  }
+
+  if err := r.put(STORE_OBJECTS_REL, key, content); err != nil {
+    return false, err
+  }
+
+  return true, nil
+}
+
+// the remote manifest is merged with the local one first, so that candidates uploaded by others aren't lost
+func (r *RemoteStore) PutManifest(key string) error {
+  if r.readOnly {
+    return nil
+  }
+
+  if err := r.FetchManifest(key); err != nil {
+    return err
+  }
+
+  content, err := ioutil.ReadFile(StoreManifestPath(key))
+  if err != nil {
+    return err
+  }
+
+  return r.put(STORE_MANIFESTS_REL, key, content)
+}
+
+// serves the remote store from dir, for testing and small teams
+func ServeRemoteStore(dir string, addr string) error {
+  for _, sub := range []string{STORE_OBJECTS_REL, STORE_MANIFESTS_REL} {
+    if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+      return err
+    }
+  }
+
+  handler := func(w http.ResponseWriter, req *http.Request) {
+    fs := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+    if len(fs) != 2 || (fs[0] != STORE_OBJECTS_REL && fs[0] != STORE_MANIFESTS_REL) || !REMOTE_KEY_RE.MatchString(fs[1]) {
+      http.Error(w, "invalid path", http.StatusBadRequest)
+      return
+    }
+
+    path := filepath.Join(dir, fs[0], fs[1])
+
+    switch req.Method {
+    case http.MethodGet, http.MethodHead:
+      content, err := ioutil.ReadFile(path)
+      if os.IsNotExist(err) {
+        http.NotFound(w, req)
+      } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+      } else {
+        w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+
+        if req.Method == http.MethodGet {
+          w.Write(content)
+        }
+      }
+    case http.MethodPut:
+      content, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, REMOTE_MAX_SIZE))
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+      }
+
+      if err := WriteFileAtomic(path, content); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+      }
+
+      w.WriteHeader(http.StatusCreated)
+    default:
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+
+    fmt.Printf("%s %s/%s\n", req.Method, fs[0], fs[1])
+  }
+
+  fmt.Printf("serving bake cache %s on %s\n", dir, addr)
+
+  return http.ListenAndServe(addr, http.HandlerFunc(handler))
+}
@@ -2,10 +2,9 @@ package main
 
 import (
   "fmt"
-  "math"
   "os"
   "os/exec"
-  "runtime"
+  "path/filepath"
   "strconv"
   "strings"
   "sync"
@@ -18,6 +17,11 @@ func SplitCommand(cmd string) (string, []string) {
 }
 
 func PrintCommand(root string, cacheDir string, cmdName string, args []string) {
+  fmt.Println(FormatCommand(root, cacheDir, cmdName, args))
+}
+
+// shortens paths in the project root, and replaces paths in the cache dir by placeholders
+func FormatCommand(root string, cacheDir string, cmdName string, args []string) string {
   var b strings.Builder
   b.WriteString(cmdName)
 
@@ -40,7 +44,13 @@ func PrintCommand(root string, cacheDir string, cmdName string, args []string) {
   }
 
   for _, arg := range args {
-    if strings.HasPrefix(arg, cacheDir) {
+    if strings.HasPrefix(arg, cacheDir) && strings.HasSuffix(arg, DEPFILE_EXT) {
+      if cacheFileCount != 0 {
+        printCacheFileInfo()
+      }
+
+      b.WriteString(" <depfile>")
+    } else if strings.HasPrefix(arg, cacheDir) {
       cacheFileCount += 1
     } else {
       if cacheFileCount != 0 {
@@ -61,7 +71,25 @@ func PrintCommand(root string, cacheDir string, cmdName string, args []string) {
     printCacheFileInfo()
   }
 
-  fmt.Println(b.String())
+  return b.String()
+}
+
+type CommandError struct {
+  Cmd string
+  Err error
+}
+
+func (e *CommandError) Error() string {
+  return e.Cmd + ": " + e.Err.Error()
+}
+
+// returned by mainInner to exit with the exit code of a command, without printing anything
+type ExitCodeError struct {
+  Code int
+}
+
+func (e *ExitCodeError) Error() string {
+  return "exit code " + strconv.Itoa(e.Code)
 }
 
 func RunCommand(cmdName string, args []string) error {
@@ -74,43 +102,94 @@ func RunCommand(cmdName string, args []string) error {
   return cmd.Run()
 }
 
-func RunPar(n int, fn func(i int) error) error {
-  nProc := runtime.NumCPU()
+func RunCommandInDir(dir string, cmdName string, args []string) error {
+  cmd := exec.Command(cmdName, args...)
 
-  if nProc > n {
-    nProc = n
-  }
+  cmd.Dir = dir
+  cmd.Stdout = os.Stdout
+  cmd.Stdin = os.Stdin
+  cmd.Stderr = os.Stderr
 
-  nGroups := int(math.Ceil(float64(n)/float64(nProc)))
+  return cmd.Run()
+}
 
-  errs := make([]error, n)
+var (
+  toolIdentities     = make(map[string]string)
+  toolIdentitiesLock = &sync.Mutex{}
 
-  for iGroup := 0; iGroup < nGroups; iGroup++ {
-    groupSize := nProc
-    if iGroup == nGroups - 1 {
-      groupSize = n - iGroup*nProc
-    }
+  portableToolIdentities     = make(map[string]string)
+  portableToolIdentitiesLock = &sync.Mutex{}
+)
 
-    var wg sync.WaitGroup
-    wg.Add(groupSize)
+// path, size, mod time and version output of a tool, so that upgrades are detected
+// only suitable for local signatures, because the path and mod time differ between machines
+func ToolIdentity(cmdName string) string {
+  toolIdentitiesLock.Lock()
 
-    for iThread := 0; iThread < groupSize; iThread++ {
-      go func(i int) {
-        errs[i] = fn(i)
+  defer toolIdentitiesLock.Unlock()
 
-        wg.Done()
-      }(iThread + iGroup*nProc)
-    }
+  if id, ok := toolIdentities[cmdName]; ok {
+    return id
+  }
 
-    wg.Wait()
+  var b strings.Builder
+
+  b.WriteString(cmdName)
 
-    for _, err := range errs {
-      if err != nil {
-        return err
+  if path, err := exec.LookPath(cmdName); err == nil {
+    if path, err = filepath.EvalSymlinks(path); err == nil {
+      b.WriteString("\n")
+      b.WriteString(path)
+
+      if stat, err := os.Stat(path); err == nil {
+        b.WriteString(fmt.Sprintf("\n%d %d", stat.Size(), stat.ModTime().UnixNano()))
       }
     }
 
+    if out, err := exec.Command(cmdName, "--version").Output(); err == nil {
+      b.WriteString("\n")
+      b.Write(out)
+    }
+  }
+
+  id := b.String()
+
+  toolIdentities[cmdName] = id
+
+  return id
+}
+
+// name, version and target of a tool (e.g. `gcc (Debian 12.2.0-14) 12.2.0` and `x86_64-linux-gnu`), which are the same on
+// every machine with the same compiler build, so that store keys can be shared between CI and developer machines
+func PortableToolIdentity(cmdName string) string {
+  portableToolIdentitiesLock.Lock()
+
+  defer portableToolIdentitiesLock.Unlock()
+
+  if id, ok := portableToolIdentities[cmdName]; ok {
+    return id
+  }
+
+  var b strings.Builder
+
+  b.WriteString(filepath.Base(cmdName))
+
+  for _, arg := range []string{"--version", "-dumpmachine"} {
+    if out, err := exec.Command(cmdName, arg).Output(); err == nil {
+      b.WriteString("\n")
+      b.Write(out)
+    }
   }
 
-  return nil
+  id := b.String()
+
+  portableToolIdentities[cmdName] = id
+
+  return id
+}
+
+func CommandSignature(cmdStr string) string {
+  cmdName, _ := SplitCommand(cmdStr)
+
+  return HashBytes([]byte(cmdStr + "\n" + ToolIdentity(cmdName)))
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+  "errors"
+  "runtime"
+  "strconv"
+  "strings"
+)
+
+type Job struct {
+  run        func() error
+  dependents []*Job
+  nPending   int // number of deps that haven't finished yet
+}
+
+// runs jobs as soon as all their deps have finished, using at most nWorkers jobs at the same time
+type Scheduler struct {
+  nWorkers  int
+  keepGoing bool
+  jobs      []*Job
+}
+
+func NewScheduler(nWorkers int, keepGoing bool) *Scheduler {
+  if nWorkers < 1 {
+    nWorkers = runtime.NumCPU()
+  }
+
+  return &Scheduler{nWorkers, keepGoing, make([]*Job, 0)}
+}
+
+// nil deps are ignored (e.g. deps that are already up-to-date)
+func (s *Scheduler) Add(run func() error, deps ...*Job) *Job {
+  j := &Job{run, make([]*Job, 0), 0}
+
+  for _, dep := range deps {
+    if dep != nil {
+      dep.dependents = append(dep.dependents, j)
+      j.nPending += 1
+    }
+  }
+
+  s.jobs = append(s.jobs, j)
+
+  return j
+}
+
+// dependents of failed jobs are never started
+// unless keepGoing is set no new jobs are started after the first failure, otherwise all errors are summarized at the end
+func (s *Scheduler) Run() error {
+  ready := make([]*Job, 0)
+  for _, j := range s.jobs {
+    if j.nPending == 0 {
+      ready = append(ready, j)
+    }
+  }
+
+  type result struct {
+    job *Job
+    err error
+  }
+
+  results := make(chan result)
+  running := 0
+
+  errs := make([]error, 0)
+  nFinished := 0
+
+  for {
+    for (len(errs) == 0 || s.keepGoing) && running < s.nWorkers && len(ready) > 0 {
+      j := ready[0]
+      ready = ready[1:]
+      running += 1
+
+      go func(j *Job) {
+        results <- result{j, j.run()}
+      }(j)
+    }
+
+    if running == 0 {
+      break
+    }
+
+    res := <-results
+    running -= 1
+    nFinished += 1
+
+    if res.err != nil {
+      errs = append(errs, res.err)
+      continue
+    }
+
+    for _, dependent := range res.job.dependents {
+      dependent.nPending -= 1
+
+      if dependent.nPending == 0 {
+        ready = append(ready, dependent)
+      }
+    }
+  }
+
+  if len(errs) == 0 {
+    return nil
+  } else if !s.keepGoing {
+    return errs[0]
+  }
+
+  var b strings.Builder
+
+  b.WriteString(strconv.Itoa(len(errs)))
+  b.WriteString(" of ")
+  b.WriteString(strconv.Itoa(len(s.jobs)))
+  b.WriteString(" jobs failed")
+
+  if nSkipped := len(s.jobs) - nFinished; nSkipped > 0 {
+    b.WriteString(" (")
+    b.WriteString(strconv.Itoa(nSkipped))
+    b.WriteString(" skipped due to failed dependencies)")
+  }
+
+  b.WriteString(":")
+
+  for _, err := range errs {
+    b.WriteString("\n  ")
+    b.WriteString(err.Error())
+  }
+
+  return errors.New(b.String())
+}
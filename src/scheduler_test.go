@@ -0,0 +1,177 @@
+package main
+
+import (
+  "errors"
+  "sync"
+  "testing"
+  "time"
+)
+
+// records the order in which jobs start and finish
+type jobLog struct {
+  mutex  sync.Mutex
+  events []string
+}
+
+func (l *jobLog) add(event string) {
+  l.mutex.Lock()
+  l.events = append(l.events, event)
+  l.mutex.Unlock()
+}
+
+func (l *jobLog) index(event string) int {
+  return FindString(l.events, event)
+}
+
+func (l *jobLog) job(name string, err error) func() error {
+  return func() error {
+    l.add("start " + name)
+    time.Sleep(time.Millisecond)
+    l.add("end " + name)
+
+    return err
+  }
+}
+
+func TestSchedulerDependencyOrder(t *testing.T) {
+  l := &jobLog{}
+  s := NewScheduler(4, false)
+
+  a := s.Add(l.job("a", nil))
+  b := s.Add(l.job("b", nil))
+  c := s.Add(l.job("c", nil), a, b)
+  s.Add(l.job("d", nil), c, nil)
+
+  if err := s.Run(); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, dep := range [][2]string{{"a", "c"}, {"b", "c"}, {"c", "d"}} {
+    if l.index("end " + dep[0]) > l.index("start " + dep[1]) {
+      t.Errorf("%s started before %s finished: %v", dep[1], dep[0], l.events)
+    }
+  }
+
+  if len(l.events) != 8 {
+    t.Errorf("expected 4 jobs to run, got %v", l.events)
+  }
+}
+
+func TestSchedulerWorkerBound(t *testing.T) {
+  const nWorkers = 3
+
+  mutex := sync.Mutex{}
+  running := 0
+  maxRunning := 0
+
+  s := NewScheduler(nWorkers, false)
+
+  for i := 0; i < 20; i++ {
+    s.Add(func() error {
+      mutex.Lock()
+      running += 1
+      if running > maxRunning {
+        maxRunning = running
+      }
+      mutex.Unlock()
+
+      time.Sleep(2*time.Millisecond)
+
+      mutex.Lock()
+      running -= 1
+      mutex.Unlock()
+
+      return nil
+    })
+  }
+
+  if err := s.Run(); err != nil {
+    t.Fatal(err)
+  }
+
+  if maxRunning > nWorkers {
+    t.Errorf("expected at most %d jobs at the same time, got %d", nWorkers, maxRunning)
+  }
+}
+
+func TestSchedulerFailedDeps(t *testing.T) {
+  for _, keepGoing := range []bool{false, true} {
+    l := &jobLog{}
+    s := NewScheduler(1, keepGoing)
+
+    a := s.Add(l.job("a", errors.New("a failed")))
+    b := s.Add(l.job("b", nil), a)
+    s.Add(l.job("c", nil), b)
+
+    if err := s.Run(); err == nil {
+      t.Errorf("keepGoing=%v: expected an error", keepGoing)
+    }
+
+    for _, name := range []string{"b", "c"} {
+      if l.index("start " + name) > -1 {
+        t.Errorf("keepGoing=%v: dependent %s of a failed job was started", keepGoing, name)
+      }
+    }
+  }
+}
+
+func TestSchedulerFailFast(t *testing.T) {
+  l := &jobLog{}
+
+  // a single worker, so that the jobs run one after the other
+  s := NewScheduler(1, false)
+
+  s.Add(l.job("a", errors.New("a failed")))
+  s.Add(l.job("b", nil))
+  s.Add(l.job("c", errors.New("c failed")))
+
+  err := s.Run()
+  if err == nil || err.Error() != "a failed" {
+    t.Fatalf("expected the first error, got %v", err)
+  }
+
+  if l.index("start b") > -1 || l.index("start c") > -1 {
+    t.Errorf("expected no jobs to start after the first failure, got %v", l.events)
+  }
+}
+
+func TestSchedulerKeepGoing(t *testing.T) {
+  l := &jobLog{}
+  s := NewScheduler(1, true)
+
+  a := s.Add(l.job("a", errors.New("a failed")))
+  s.Add(l.job("b", nil))
+  s.Add(l.job("c", errors.New("c failed")))
+  s.Add(l.job("d", nil), a)
+
+  err := s.Run()
+  if err == nil {
+    t.Fatal("expected an error")
+  }
+
+  if l.index("end b") == -1 || l.index("end c") == -1 {
+    t.Errorf("expected the independent jobs to run, got %v", l.events)
+  }
+
+  want := "2 of 4 jobs failed (1 skipped due to failed dependencies):\n  a failed\n  c failed"
+  if err.Error() != want {
+    t.Errorf("expected %q, got %q", want, err.Error())
+  }
+}
+
+func TestSchedulerKeepGoingWithoutSkipped(t *testing.T) {
+  s := NewScheduler(2, true)
+
+  s.Add(func() error { return errors.New("a failed") })
+  s.Add(func() error { return nil })
+
+  err := s.Run()
+  if err == nil {
+    t.Fatal("expected an error")
+  }
+
+  want := "1 of 2 jobs failed:\n  a failed"
+  if err.Error() != want {
+    t.Errorf("expected %q, got %q", want, err.Error())
+  }
+}
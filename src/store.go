@@ -0,0 +1,506 @@
+package main
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+)
+
+// The object store is shared by all checkouts, and works like ccache's direct mode:
+//  * the manifest key is the hash of the normalized compile command, the compiler identity and the source content
+//  * the store manifest lists candidate results, each with the content hashes of the headers used
+//  * the object of a candidate is reused if all its headers are unchanged
+// Paths inside the project root are stored relative to the root, so that different checkouts share the same keys.
+// PCHs aren't stored, because they embed abs paths and mod times of the headers, and are cheap to rebuild locally.
+
+const (
+  STORE_DIR_REL       = "store"
+  STORE_OBJECTS_REL   = "objects"
+  STORE_MANIFESTS_REL = "manifests"
+  STORE_MAX_CANDIDATES = 16
+
+  ROOT_PLACEHOLDER = "{root}"
+)
+
+type StoreDep struct {
+  Path string // relative to the project root if prefixed by ROOT_PLACEHOLDER
+  Hash string
+}
+
+type StoreCandidate struct {
+  Result string
+  Digest string // content hash of the object, so that fetched objects can be verified (empty for older manifests)
+  Deps   []StoreDep
+}
+
+func StoreDir() string {
+  return filepath.Join(CACHE_DIR, STORE_DIR_REL)
+}
+
+func StoreObjectPath(key string) string {
+  return filepath.Join(StoreDir(), STORE_OBJECTS_REL, key)
+}
+
+func StoreManifestPath(key string) string {
+  return filepath.Join(StoreDir(), STORE_MANIFESTS_REL, key)
+}
+
+// format: candidates are separated by empty lines, each candidate starts with a `result <key> [<digest>]` line,
+// followed by `<hash> <path>` lines
+func ReadStoreManifest(key string) ([]StoreCandidate, error) {
+  b, err := ioutil.ReadFile(StoreManifestPath(key))
+  if err != nil {
+    if os.IsNotExist(err) {
+      return []StoreCandidate{}, nil
+    }
+
+    return nil, err
+  }
+
+  return ParseStoreManifest(b)
+}
+
+func ParseStoreManifest(b []byte) ([]StoreCandidate, error) {
+  candidates := make([]StoreCandidate, 0)
+
+  for _, block := range strings.Split(string(b), "\n\n") {
+    lines := strings.Split(strings.TrimSpace(block), "\n")
+    if len(lines) == 0 || !strings.HasPrefix(lines[0], "result ") {
+      continue
+    }
+
+    head := strings.Fields(lines[0])
+    if len(head) < 2 {
+      continue
+    }
+
+    c := StoreCandidate{head[1], "", make([]StoreDep, 0)}
+    if len(head) > 2 {
+      c.Digest = head[2]
+    }
+
+    for _, line := range lines[1:] {
+      fs := strings.SplitN(line, " ", 2)
+      if len(fs) == 2 {
+        c.Deps = append(c.Deps, StoreDep{fs[1], fs[0]})
+      }
+    }
+
+    candidates = append(candidates, c)
+  }
+
+  return candidates, nil
+}
+
+// candidates of a come first, the result is truncated to STORE_MAX_CANDIDATES
+func MergeStoreCandidates(a []StoreCandidate, b []StoreCandidate) []StoreCandidate {
+  res := make([]StoreCandidate, 0)
+  results := make(map[string]bool)
+
+  for _, c := range append(append([]StoreCandidate{}, a...), b...) {
+    if !results[c.Result] {
+      res = append(res, c)
+      results[c.Result] = true
+    }
+  }
+
+  if len(res) > STORE_MAX_CANDIDATES {
+    res = res[0:STORE_MAX_CANDIDATES]
+  }
+
+  return res
+}
+
+func WriteStoreManifest(key string, candidates []StoreCandidate) error {
+  var b strings.Builder
+
+  for _, c := range candidates {
+    b.WriteString("result ")
+    b.WriteString(c.Result)
+
+    if c.Digest != "" {
+      b.WriteString(" ")
+      b.WriteString(c.Digest)
+    }
+
+    b.WriteString("\n")
+
+    for _, dep := range c.Deps {
+      b.WriteString(dep.Hash)
+      b.WriteString(" ")
+      b.WriteString(dep.Path)
+      b.WriteString("\n")
+    }
+
+    b.WriteString("\n")
+  }
+
+  return WriteFileAtomic(StoreManifestPath(key), []byte(b.String()))
+}
+
+// writes to a tmp file in the same dir first, so concurrent readers never see partial content
+func WriteFileAtomic(path string, content []byte) error {
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return err
+  }
+
+  fd, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + "*" + TMP_EXT)
+  if err != nil {
+    return err
+  }
+
+  tmp := fd.Name()
+
+  if _, err := fd.Write(content); err != nil {
+    fd.Close()
+    os.Remove(tmp)
+    return err
+  }
+
+  if err := fd.Close(); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+
+  return os.Rename(tmp, path)
+}
+
+// hard links are preferred, copies are only made across devices
+func LinkOrCopyFile(src string, dst string) error {
+  if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+    return err
+  }
+
+  if err := os.Link(src, dst); err == nil {
+    return nil
+  }
+
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  fd, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst) + "*" + TMP_EXT)
+  if err != nil {
+    return err
+  }
+
+  tmp := fd.Name()
+
+  if _, err := io.Copy(fd, in); err != nil {
+    fd.Close()
+    os.Remove(tmp)
+    return err
+  }
+
+  if err := fd.Close(); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+
+  return os.Rename(tmp, dst)
+}
+
+func (p *ProjectData) NormalizePath(path string) string {
+  if strings.HasPrefix(path, p.root + string(filepath.Separator)) {
+    return ROOT_PLACEHOLDER + strings.TrimPrefix(path, p.root)
+  }
+
+  return path
+}
+
+func (p *ProjectData) DenormalizePath(path string) string {
+  if strings.HasPrefix(path, ROOT_PLACEHOLDER) {
+    return p.root + strings.TrimPrefix(path, ROOT_PLACEHOLDER)
+  }
+
+  return path
+}
+
+func (p *CProject) storeManifestKey(f *File, cmdStr string) (string, error) {
+  hash, err := f.Hash()
+  if err != nil {
+    return "", err
+  }
+
+  // checkout specific paths
+  normCmd := cmdStr
+  normCmd = strings.ReplaceAll(normCmd, p.DepfilePath(f), "{depfile}")
+  normCmd = strings.ReplaceAll(normCmd, p.ObjPath(f), "{output}")
+
+  if pch, err := p.getPchFile(); err == nil && pch != nil {
+    normCmd = strings.ReplaceAll(normCmd, p.PchPath(pch), "{pch}")
+  }
+
+  // objects are shared across checkouts, unless the debug info embeds the abs paths of the root (like ccache's hash_dir)
+  normCmd = replaceRoot(normCmd, p.root)
+
+  rootKey := ROOT_PLACEHOLDER
+  if _, args := SplitCommand(cmdStr); EmbedsRoot(args, p.root) && !p.config.ShareRoots {
+    rootKey = p.root
+  }
+
+  cmdName, _ := SplitCommand(cmdStr)
+
+  return HashBytes([]byte(normCmd + "\n" + PortableToolIdentity(cmdName) + "\n" + rootKey + "\n" + hash)), nil
+}
+
+// -g (except -g0) without a -fdebug-prefix-map or -ffile-prefix-map that covers the root
+func EmbedsRoot(args []string, root string) bool {
+  debug := false
+
+  for _, arg := range args {
+    if strings.HasPrefix(arg, "-g") && arg != "-g0" && !strings.HasPrefix(arg, "-gno-") {
+      debug = true
+    }
+  }
+
+  if !debug {
+    return false
+  }
+
+  for _, arg := range args {
+    for _, flag := range []string{"-fdebug-prefix-map=", "-ffile-prefix-map="} {
+      if !strings.HasPrefix(arg, flag) {
+        continue
+      }
+
+      old := strings.SplitN(strings.TrimPrefix(arg, flag), "=", 2)[0]
+      old = strings.TrimRight(old, string(filepath.Separator))
+
+      if old != "" && (root == old || strings.HasPrefix(root, old + string(filepath.Separator))) {
+        return false
+      }
+    }
+  }
+
+  return true
+}
+
+// only whole paths are replaced, so that siblings sharing a prefix with the root (e.g. /a/bc for /a/b) are kept
+func replaceRoot(cmdStr string, root string) string {
+  re := regexp.MustCompile(regexp.QuoteMeta(root) + `([/\s"'=:,;]|$)`)
+
+  return re.ReplaceAllString(cmdStr, ROOT_PLACEHOLDER + "${1}")
+}
+
+// the headers of the pch are also part of the result key, because the pch is compiled into the object
+func (p *CProject) storeDeps(f *File) ([]StoreDep, error) {
+  m, err := ReadManifest(p.ObjPath(f))
+  if err != nil {
+    return nil, err
+  }
+
+  entries := make(map[string]string)
+  for path, entry := range m.Entries {
+    entries[path] = entry.Hash
+  }
+
+  if pch, err := p.getPchFile(); err == nil && pch != nil {
+    for _, dep := range pch.ListDeepDeps() {
+      hash, err := dep.Hash()
+      if err != nil {
+        return nil, err
+      }
+
+      entries[dep.Path] = hash
+    }
+  }
+
+  deps := make([]StoreDep, 0)
+  for path, hash := range entries {
+    deps = append(deps, StoreDep{p.NormalizePath(path), hash})
+  }
+
+  sort.Slice(deps, func(i, j int) bool {
+    return deps[i].Path < deps[j].Path
+  })
+
+  return deps, nil
+}
+
+func storeResultKey(manifestKey string, deps []StoreDep) string {
+  var b strings.Builder
+
+  b.WriteString(manifestKey)
+
+  for _, dep := range deps {
+    b.WriteString("\n")
+    b.WriteString(dep.Hash)
+    b.WriteString(" ")
+    b.WriteString(dep.Path)
+  }
+
+  return HashBytes([]byte(b.String()))
+}
+
+// on success the object is linked into the regular object path, and its manifest is written
+// the remote store is only consulted if there is no local hit, remote failures are never fatal
+// local hits aren't uploaded (objects are only uploaded after compiling them), so up-to-date builds don't contact the remote
+func (p *CProject) FetchObjFromStore(f *File, cmdStr string) (bool, error) {
+  manifestKey, err := p.storeManifestKey(f, cmdStr)
+  if err != nil {
+    return false, nil
+  }
+
+  hit, err := p.fetchObjFromStore(f, cmdStr, manifestKey)
+  if hit || err != nil || p.remote == nil {
+    return hit, err
+  }
+
+  if err := p.remote.FetchManifest(manifestKey); err != nil {
+    return false, nil
+  }
+
+  return p.fetchObjFromStore(f, cmdStr, manifestKey)
+}
+
+func (p *CProject) fetchObjFromStore(f *File, cmdStr string, manifestKey string) (bool, error) {
+  candidates, err := ReadStoreManifest(manifestKey)
+  if err != nil {
+    return false, nil
+  }
+
+  for _, c := range candidates {
+    files, ok := p.matchStoreCandidate(f, c)
+    if !ok {
+      continue
+    }
+
+    src := StoreObjectPath(c.Result)
+    if _, err := os.Stat(src); err != nil {
+      if p.remote == nil {
+        continue
+      }
+
+      if fetched, err := p.remote.FetchObject(c.Result, c.Digest); err != nil || !fetched {
+        continue
+      }
+    }
+
+    dst := p.ObjPath(f)
+
+    if err := RemoveManifest(dst); err != nil {
+      return false, err
+    }
+
+    if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+      return false, err
+    }
+
+    if err := LinkOrCopyFile(src, dst); err != nil {
+      return false, err
+    }
+
+    // so that `bake --cache prune` knows the object is still being used
+    now := time.Now()
+    os.Chtimes(src, now, now)
+
+    if err := WriteRecordedManifest(dst, p.root, f.Path, CommandSignature(cmdStr), files); err != nil {
+      return false, err
+    }
+
+    return true, nil
+  }
+
+  return false, nil
+}
+
+// returns the files of the candidate that are relevant for the object manifest (i.e. without the pch deps)
+func (p *CProject) matchStoreCandidate(f *File, c StoreCandidate) ([]*File, bool) {
+  pchDeps := make(map[string]bool)
+  if pch, err := p.getPchFile(); err == nil && pch != nil {
+    for _, dep := range pch.ListDeepDeps() {
+      pchDeps[dep.Path] = true
+    }
+  }
+
+  files := make([]*File, 0)
+
+  for _, dep := range c.Deps {
+    depFile, err := p.LookupFile(p.DenormalizePath(dep.Path))
+    if err != nil {
+      return nil, false
+    }
+
+    hash, err := depFile.Hash()
+    if err != nil || hash != dep.Hash {
+      return nil, false
+    }
+
+    if !pchDeps[depFile.Path] || depFile == f {
+      files = append(files, depFile)
+    }
+  }
+
+  return SortUniqueFiles(files), true
+}
+
+func (p *CProject) PutObjInStore(f *File, cmdStr string) error {
+  manifestKey, err := p.storeManifestKey(f, cmdStr)
+  if err != nil {
+    return err
+  }
+
+  deps, err := p.storeDeps(f)
+  if err != nil {
+    return err
+  }
+
+  resultKey := storeResultKey(manifestKey, deps)
+
+  dst := StoreObjectPath(resultKey)
+  if _, err := os.Stat(dst); err != nil {
+    if err := LinkOrCopyFile(p.ObjPath(f), dst); err != nil {
+      return err
+    }
+  }
+
+  content, err := ioutil.ReadFile(dst)
+  if err != nil {
+    return err
+  }
+
+  digest := HashBytes(content)
+
+  candidates, err := ReadStoreManifest(manifestKey)
+  if err != nil {
+    return err
+  }
+
+  known := false
+  for _, c := range candidates {
+    if c.Result == resultKey && c.Digest == digest {
+      known = true
+    }
+  }
+
+  if !known {
+    candidates = MergeStoreCandidates([]StoreCandidate{StoreCandidate{resultKey, digest, deps}}, candidates)
+
+    if err := WriteStoreManifest(manifestKey, candidates); err != nil {
+      return err
+    }
+  }
+
+  // the remote might lack objects that are already in the local store (e.g. built while offline, or before the remote was configured)
+  if p.remote != nil {
+    uploaded, err := p.remote.PutObject(resultKey)
+    if err != nil {
+      return err
+    }
+
+    if uploaded || !known {
+      return p.remote.PutManifest(manifestKey)
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestEmbedsRoot(t *testing.T) {
+  tests := []struct {
+    cmd  string
+    want bool
+  }{
+    {"gcc -O2 -c a.c", false},
+    {"gcc -g -c a.c", true},
+    {"gcc -ggdb3 -c a.c", true},
+    {"gcc -g0 -c a.c", false},
+    {"gcc -gno-column-info -c a.c", false},
+    {"gcc -g -fdebug-prefix-map=/src/proj=. -c a.c", false},
+    {"gcc -g -ffile-prefix-map=/src/=/ -c a.c", false},
+    {"gcc -g -fdebug-prefix-map=/src/projx=. -c a.c", true},
+    {"gcc -g -fdebug-prefix-map=/other=. -c a.c", true},
+  }
+
+  for _, test := range tests {
+    if got := EmbedsRoot(strings.Fields(test.cmd), "/src/proj"); got != test.want {
+      t.Errorf("%q: expected %v, got %v", test.cmd, test.want, got)
+    }
+  }
+}
+
+func TestReplaceRoot(t *testing.T) {
+  got := replaceRoot("gcc -I/src/proj/inc -I/src/projx -c /src/proj/a.c -DROOT=\"/src/proj\"", "/src/proj")
+  want := "gcc -I{root}/inc -I/src/projx -c {root}/a.c -DROOT=\"{root}\""
+
+  if got != want {
+    t.Errorf("expected %q, got %q", want, got)
+  }
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+  "context"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  TESTS_DIR_REL        = "tests"
+  JUNIT_XML            = "junit.xml"
+  DEFAULT_TEST_TIMEOUT = 10*time.Minute
+)
+
+type TestResult struct {
+  Name     string
+  Duration time.Duration
+  Output   []byte
+  Err      error // nil if the test passed
+}
+
+func (p *CProject) TestDir() string {
+  return filepath.Join(p.dstDir, TESTS_DIR_REL)
+}
+
+// the junit report is written to BAKE_JUNIT, or to junit.xml in the tests dir
+func (p *CProject) JUnitPath() string {
+  if path := os.Getenv("BAKE_JUNIT"); path != "" {
+    return path
+  }
+
+  return filepath.Join(p.TestDir(), JUNIT_XML)
+}
+
+// e.g. `10s`, `2m`
+func ParseTestTimeout(s string) (time.Duration, error) {
+  d, err := time.ParseDuration(s)
+  if err != nil || d <= 0 {
+    return 0, errors.New("invalid test timeout " + s)
+  }
+
+  return d, nil
+}
+
+// the timeout is passed via BAKE_TEST_TIMEOUT
+func TestTimeout() (time.Duration, error) {
+  if s := os.Getenv("BAKE_TEST_TIMEOUT"); s != "" {
+    return ParseTestTimeout(s)
+  }
+
+  return DEFAULT_TEST_TIMEOUT, nil
+}
+
+// all tests are linked into the same dir, so tests with the same name would overwrite each other
+func (p *CProject) checkTestNames(testFiles []*File) error {
+  names := make(map[string]*File)
+
+  for _, f := range testFiles {
+    name := p.ExeName(f)
+
+    if other, ok := names[name]; ok {
+      return errors.New("both " + p.FormatPath(other.Path) + " and " + p.FormatPath(f.Path) + " are named test " + name + " (use `//! test <name>`)")
+    }
+
+    names[name] = f
+  }
+
+  return nil
+}
+
+func (p *CProject) buildTests(testFiles []*File) error {
+  s := p.NewScheduler()
+
+  pchJob, err := p.schedulePch(s)
+  if err != nil {
+    return err
+  }
+
+  cppFiles := make([]*File, 0)
+  for _, f := range testFiles {
+    cppFiles = append(cppFiles, p.ListExeObjFiles(f)...)
+  }
+
+  cppFiles = FilterFiles(SortUniqueFiles(cppFiles), func(f *File) bool {
+    return p.NeedsRebuild("obj", f.Path, func() *Reason { return p.ObjOutdated(f) })
+  })
+
+  objJobs := p.scheduleObjs(s, cppFiles, pchJob)
+
+  for _, f := range testFiles {
+    if p.NeedsRebuild("test", p.ExePath(f), func() *Reason { return p.ExeOutdated(f) }) {
+      p.scheduleExe(s, f, objJobs)
+    }
+  }
+
+  return s.Run()
+}
+
+// tests are run in parallel from the project root, a test passes if it exits with 0
+func (p *CProject) Test() error {
+  testFiles := p.FilterFiles(func(f *File) bool {
+    return p.IsTestFile(f)
+  })
+
+  if len(testFiles) == 0 {
+    fmt.Println("no tests found")
+    return nil
+  }
+
+  if err := p.checkTestNames(testFiles); err != nil {
+    return err
+  }
+
+  timeout, err := TestTimeout()
+  if err != nil {
+    return err
+  }
+
+  if err := p.buildTests(testFiles); err != nil {
+    return err
+  }
+
+  if p.dryRun {
+    for _, f := range testFiles {
+      fmt.Println(p.FormatPath(p.ExePath(f)))
+    }
+
+    return nil
+  }
+
+  results := make([]*TestResult, len(testFiles))
+  printMutex := &sync.Mutex{}
+
+  // keepGoing, so that failing tests don't stop the others
+  s := NewScheduler(p.jobs, true)
+
+  for i, f := range testFiles {
+    i, f := i, f
+
+    s.Add(func() error {
+      res := p.runTest(f, timeout)
+
+      printMutex.Lock()
+      printTestResult(res)
+      printMutex.Unlock()
+
+      results[i] = res
+
+      return nil
+    })
+  }
+
+  if err := s.Run(); err != nil {
+    return err
+  }
+
+  if err := WriteJUnit(p.JUnitPath(), results); err != nil {
+    return err
+  }
+
+  nFailed := 0
+  for _, res := range results {
+    if res.Err != nil {
+      nFailed += 1
+    }
+  }
+
+  fmt.Printf("%d tests, %d failed\n", len(results), nFailed)
+
+  if nFailed > 0 {
+    return errors.New(strconv.Itoa(nFailed) + " of " + strconv.Itoa(len(results)) + " tests failed")
+  }
+
+  return nil
+}
+
+// a test that doesn't finish in time is killed, and fails
+func (p *CProject) runTest(f *File, timeout time.Duration) *TestResult {
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+
+  cmd := exec.CommandContext(ctx, p.ExePath(f))
+  cmd.Dir = p.root
+
+  start := time.Now()
+
+  out, err := cmd.CombinedOutput()
+  if ctx.Err() == context.DeadlineExceeded {
+    err = errors.New("timed out after " + timeout.String())
+  }
+
+  return &TestResult{p.ExeName(f), time.Since(start), out, err}
+}
+
+// output is only shown for failed tests
+func printTestResult(res *TestResult) {
+  if res.Err == nil {
+    fmt.Printf("PASS %s (%.3fs)\n", res.Name, res.Duration.Seconds())
+    return
+  }
+
+  fmt.Printf("FAIL %s (%.3fs): %s\n", res.Name, res.Duration.Seconds(), res.Err.Error())
+
+  for _, line := range strings.Split(strings.TrimRight(string(res.Output), "\n"), "\n") {
+    fmt.Printf("    %s\n", line)
+  }
+}
+
+type junitTestSuites struct {
+  XMLName  xml.Name         `xml:"testsuites"`
+  Tests    int              `xml:"tests,attr"`
+  Failures int              `xml:"failures,attr"`
+  Time     string           `xml:"time,attr"`
+  Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+  Name     string          `xml:"name,attr"`
+  Tests    int             `xml:"tests,attr"`
+  Failures int             `xml:"failures,attr"`
+  Time     string          `xml:"time,attr"`
+  Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+  Name      string        `xml:"name,attr"`
+  ClassName string        `xml:"classname,attr"`
+  Time      string        `xml:"time,attr"`
+  Failure   *junitFailure `xml:"failure,omitempty"`
+  SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+  Message string `xml:"message,attr"`
+  Content string `xml:",chardata"`
+}
+
+func formatJUnitTime(d time.Duration) string {
+  return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func WriteJUnit(path string, results []*TestResult) error {
+  suite := junitTestSuite{"bake", len(results), 0, "", make([]junitTestCase, 0)}
+
+  var total time.Duration
+
+  for _, res := range results {
+    c := junitTestCase{res.Name, "bake", formatJUnitTime(res.Duration), nil, string(res.Output)}
+
+    if res.Err != nil {
+      c.Failure = &junitFailure{res.Err.Error(), string(res.Output)}
+      suite.Failures += 1
+    }
+
+    suite.Cases = append(suite.Cases, c)
+    total += res.Duration
+  }
+
+  suite.Time = formatJUnitTime(total)
+
+  b, err := xml.MarshalIndent(junitTestSuites{xml.Name{}, suite.Tests, suite.Failures, suite.Time, []junitTestSuite{suite}}, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return err
+  }
+
+  return ioutil.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
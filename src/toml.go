@@ -0,0 +1,312 @@
+package main
+
+import (
+  "errors"
+  "strconv"
+  "strings"
+)
+
+// parses the subset of toml needed for bake.toml:
+//  * `[table]` and `[dotted.table]` headers, bare, quoted and dotted keys, and `#` comments
+//  * single-line basic ("...", with escapes) and literal ('...') strings, booleans, decimal integers, and arrays (which can span lines)
+// multi-line strings, arrays of tables (`[[...]]`), inline tables, floats and dates are rejected with an error
+// the result has the same shape as json decoded into interface{}, so it can be converted to structs via encoding/json
+func ParseToml(src string, name string) (map[string]interface{}, error) {
+  t := &tomlParser{src, 0, 1, name}
+
+  root := make(map[string]interface{})
+  table := root
+
+  for {
+    t.skipBlank()
+
+    if t.eof() {
+      break
+    }
+
+    if t.peek() == '[' {
+      t.pos++
+
+      if !t.eof() && t.peek() == '[' {
+        return nil, t.error("arrays of tables ([[...]]) aren't supported")
+      }
+
+      keys, err := t.parseKeys()
+      if err != nil {
+        return nil, err
+      }
+
+      if !t.consume(']') {
+        return nil, t.error("expected ]")
+      }
+
+      table, err = t.lookupTable(root, keys)
+      if err != nil {
+        return nil, err
+      }
+    } else {
+      keys, err := t.parseKeys()
+      if err != nil {
+        return nil, err
+      }
+
+      if !t.consume('=') {
+        return nil, t.error("expected =")
+      }
+
+      val, err := t.parseValue()
+      if err != nil {
+        return nil, err
+      }
+
+      parent, err := t.lookupTable(table, keys[0:len(keys)-1])
+      if err != nil {
+        return nil, err
+      }
+
+      key := keys[len(keys)-1]
+      if _, ok := parent[key]; ok {
+        return nil, t.error("duplicate key " + key)
+      }
+
+      parent[key] = val
+    }
+
+    t.skipSpace()
+
+    if !t.eof() && t.peek() != '\n' {
+      return nil, t.error("expected end of line")
+    }
+  }
+
+  return root, nil
+}
+
+type tomlParser struct {
+  src  string
+  pos  int
+  line int
+  name string
+}
+
+func (t *tomlParser) error(msg string) error {
+  return errors.New(t.name + ":" + strconv.Itoa(t.line) + ": " + msg)
+}
+
+func (t *tomlParser) eof() bool {
+  return t.pos >= len(t.src)
+}
+
+func (t *tomlParser) peek() byte {
+  return t.src[t.pos]
+}
+
+// skips spaces and a trailing comment, but not newlines
+func (t *tomlParser) skipSpace() {
+  for !t.eof() {
+    c := t.peek()
+
+    if c == ' ' || c == '\t' || c == '\r' {
+      t.pos++
+    } else if c == '#' {
+      for !t.eof() && t.peek() != '\n' {
+        t.pos++
+      }
+    } else {
+      break
+    }
+  }
+}
+
+// skips spaces, comments and newlines
+func (t *tomlParser) skipBlank() {
+  for {
+    t.skipSpace()
+
+    if t.eof() || t.peek() != '\n' {
+      return
+    }
+
+    t.pos++
+    t.line++
+  }
+}
+
+func (t *tomlParser) consume(c byte) bool {
+  t.skipSpace()
+
+  if !t.eof() && t.peek() == c {
+    t.pos++
+    return true
+  }
+
+  return false
+}
+
+// dotted keys, each part is either bare or quoted
+func (t *tomlParser) parseKeys() ([]string, error) {
+  keys := make([]string, 0)
+
+  for {
+    t.skipSpace()
+
+    if t.eof() {
+      return nil, t.error("expected key")
+    }
+
+    if c := t.peek(); c == '"' || c == '\'' {
+      key, err := t.parseString()
+      if err != nil {
+        return nil, err
+      }
+
+      keys = append(keys, key)
+    } else {
+      start := t.pos
+      for !t.eof() && isTomlBareKeyChar(t.peek()) {
+        t.pos++
+      }
+
+      if start == t.pos {
+        return nil, t.error("expected key")
+      }
+
+      keys = append(keys, t.src[start:t.pos])
+    }
+
+    if !t.consume('.') {
+      return keys, nil
+    }
+  }
+}
+
+func isTomlBareKeyChar(c byte) bool {
+  return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+func (t *tomlParser) parseString() (string, error) {
+  if strings.HasPrefix(t.src[t.pos:], `"""`) || strings.HasPrefix(t.src[t.pos:], "'''") {
+    return "", t.error("multi-line strings aren't supported")
+  }
+
+  quote := t.peek()
+  start := t.pos
+  t.pos++
+
+  for !t.eof() && t.peek() != quote && t.peek() != '\n' {
+    if quote == '"' && t.peek() == '\\' {
+      t.pos++
+    }
+
+    t.pos++
+  }
+
+  if t.eof() || t.peek() != quote {
+    return "", t.error("unterminated string")
+  }
+
+  t.pos++
+
+  raw := t.src[start:t.pos]
+
+  if quote == '\'' {
+    return raw[1:len(raw)-1], nil
+  }
+
+  s, err := strconv.Unquote(raw)
+  if err != nil {
+    return "", t.error("invalid string " + raw)
+  }
+
+  return s, nil
+}
+
+func (t *tomlParser) parseValue() (interface{}, error) {
+  t.skipSpace()
+
+  if t.eof() {
+    return nil, t.error("expected value")
+  }
+
+  switch c := t.peek(); {
+  case c == '"' || c == '\'':
+    return t.parseString()
+  case c == '[':
+    return t.parseArray()
+  case c == '{':
+    return nil, t.error("inline tables aren't supported")
+  default:
+    start := t.pos
+    for !t.eof() && isTomlBareKeyChar(t.peek()) {
+      t.pos++
+    }
+
+    word := t.src[start:t.pos]
+
+    if word == "true" {
+      return true, nil
+    } else if word == "false" {
+      return false, nil
+    } else if n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64); err == nil {
+      // encoding/json decodes numbers as float64
+      return float64(n), nil
+    } else {
+      return nil, t.error("invalid value " + word)
+    }
+  }
+}
+
+// arrays can span multiple lines
+func (t *tomlParser) parseArray() ([]interface{}, error) {
+  t.pos++
+
+  res := make([]interface{}, 0)
+
+  for {
+    t.skipBlank()
+
+    if t.eof() {
+      return nil, t.error("unterminated array")
+    }
+
+    if t.peek() == ']' {
+      t.pos++
+      return res, nil
+    }
+
+    val, err := t.parseValue()
+    if err != nil {
+      return nil, err
+    }
+
+    res = append(res, val)
+
+    t.skipBlank()
+
+    if t.eof() {
+      return nil, t.error("unterminated array")
+    } else if t.peek() == ',' {
+      t.pos++
+    } else if t.peek() != ']' {
+      return nil, t.error("expected , or ]")
+    }
+  }
+}
+
+// creates missing tables along the way
+func (t *tomlParser) lookupTable(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+  for _, key := range keys {
+    child, ok := table[key]
+    if !ok {
+      child = make(map[string]interface{})
+      table[key] = child
+    }
+
+    table, ok = child.(map[string]interface{})
+    if !ok {
+      return nil, t.error(key + " isn't a table")
+    }
+  }
+
+  return table, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseToml(t *testing.T) {
+  tests := []struct {
+    name string
+    src  string
+    want map[string]interface{}
+  }{
+    {
+      "top-level keys",
+      "project = \"c\"\nfollow-symlinks = true\njobs = 1_000\n",
+      map[string]interface{}{"project": "c", "follow-symlinks": true, "jobs": float64(1000)},
+    },
+    {
+      "tables",
+      "a = 1\n[profiles]\nb = 2\n[profiles.release]\ndst = \"build/release\"\n",
+      map[string]interface{}{
+        "a": float64(1),
+        "profiles": map[string]interface{}{
+          "b": float64(2),
+          "release": map[string]interface{}{"dst": "build/release"},
+        },
+      },
+    },
+    {
+      "dotted and quoted keys",
+      "profiles.debug.dst = \"d\"\n[lib-map]\n\"<GL/*>\" = [\"GL\"]\n'<x.h>' = []\n",
+      map[string]interface{}{
+        "profiles": map[string]interface{}{"debug": map[string]interface{}{"dst": "d"}},
+        "lib-map": map[string]interface{}{"<GL/*>": []interface{}{"GL"}, "<x.h>": []interface{}{}},
+      },
+    },
+    {
+      "arrays across lines",
+      "libs = [\n  \"m\", # math\n  \"pthread\",\n\n  [1, 2]\n]\n",
+      map[string]interface{}{"libs": []interface{}{"m", "pthread", []interface{}{float64(1), float64(2)}}},
+    },
+    {
+      "basic and literal strings",
+      "a = \"x\\ty\\\"z\"\nb = 'C:\\dir\\n'\n",
+      map[string]interface{}{"a": "x\ty\"z", "b": "C:\\dir\\n"},
+    },
+    {
+      "comments",
+      "# header\n\n  a = \"#not a comment\" # comment\n[t] # table comment\n",
+      map[string]interface{}{"a": "#not a comment", "t": map[string]interface{}{}},
+    },
+    {
+      "crlf",
+      "a = 1\r\nb = 'x'\r\n",
+      map[string]interface{}{"a": float64(1), "b": "x"},
+    },
+  }
+
+  for _, test := range tests {
+    got, err := ParseToml(test.src, "bake.toml")
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: expected %#v, got %#v", test.name, test.want, got)
+    }
+  }
+}
+
+func TestParseTomlErrors(t *testing.T) {
+  tests := []struct {
+    src  string
+    want string // expected error, including the line number
+  }{
+    {"a = 1\na = 2\n", "bake.toml:2: duplicate key a"},
+    {"[t]\na = 1\n[u]\nx = 1\n[t]\na = 2\n", "bake.toml:6: duplicate key a"},
+    {"a.b = 1\na.b = 2\n", "bake.toml:2: duplicate key b"},
+    {"a = 1\na.b = 2\n", "bake.toml:2: a isn't a table"},
+    {"a = \"\"\"x\"\"\"\n", "bake.toml:1: multi-line strings aren't supported"},
+    {"a = '''x'''\n", "bake.toml:1: multi-line strings aren't supported"},
+    {"\n[[bin]]\nname = \"x\"\n", "bake.toml:2: arrays of tables ([[...]]) aren't supported"},
+    {"a = { b = 1 }\n", "bake.toml:1: inline tables aren't supported"},
+    {"a = \"x\n", "bake.toml:1: unterminated string"},
+    {"a = [1, 2\n", "bake.toml:2: unterminated array"},
+    {"a = [1 2]\n", "bake.toml:1: expected , or ]"},
+    {"a = 1 b = 2\n", "bake.toml:1: expected end of line"},
+    {"a 1\n", "bake.toml:1: expected ="},
+    {"[t\n", "bake.toml:1: expected ]"},
+    {"a = yes\n", "bake.toml:1: invalid value yes"},
+  }
+
+  for _, test := range tests {
+    _, err := ParseToml(test.src, "bake.toml")
+    if err == nil {
+      t.Errorf("%q: expected an error", test.src)
+    } else if !strings.HasPrefix(err.Error(), test.want) {
+      t.Errorf("%q: expected %q, got %q", test.src, test.want, err.Error())
+    }
+  }
+}
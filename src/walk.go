@@ -0,0 +1,317 @@
+package main
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "sync"
+)
+
+var (
+  IGNORE_FILES = []string{".gitignore", ".bakeignore"} // later files override earlier ones
+)
+
+// a gitignore style glob, relative to the dir of the ignore file (or to the project root)
+// patterns without a slash match the name at any depth, `**` matches any number of dirs
+type GlobRule struct {
+  base     string
+  parts    []string
+  anchored bool
+  dirOnly  bool
+  negate   bool
+}
+
+func ParseGlobRule(base string, pattern string) (*GlobRule, error) {
+  r := &GlobRule{base: base}
+
+  if strings.HasPrefix(pattern, "!") {
+    r.negate = true
+    pattern = pattern[1:]
+  }
+
+  if strings.HasSuffix(pattern, "/") {
+    r.dirOnly = true
+    pattern = strings.TrimRight(pattern, "/")
+  }
+
+  if strings.Contains(pattern, "/") {
+    r.anchored = true
+    pattern = strings.TrimPrefix(pattern, "/")
+  }
+
+  if pattern == "" {
+    return nil, errors.New("empty glob")
+  }
+
+  r.parts = strings.Split(pattern, "/")
+
+  for _, part := range r.parts {
+    if _, err := path.Match(part, ""); err != nil {
+      return nil, errors.New("invalid glob " + pattern)
+    }
+  }
+
+  return r, nil
+}
+
+func (r *GlobRule) Match(fpath string, isDir bool) bool {
+  if r.dirOnly && !isDir {
+    return false
+  }
+
+  rel, err := filepath.Rel(r.base, fpath)
+  if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+    return false
+  }
+
+  names := strings.Split(filepath.ToSlash(rel), "/")
+
+  if !r.anchored {
+    ok, _ := path.Match(r.parts[0], names[len(names)-1])
+    return ok
+  }
+
+  return matchGlobParts(r.parts, names)
+}
+
+func matchGlobParts(parts []string, names []string) bool {
+  if len(parts) == 0 {
+    return len(names) == 0
+  }
+
+  if parts[0] == "**" {
+    for i := 0; i <= len(names); i++ {
+      if matchGlobParts(parts[1:], names[i:]) {
+        return true
+      }
+    }
+
+    return false
+  }
+
+  if len(names) == 0 {
+    return false
+  }
+
+  if ok, _ := path.Match(parts[0], names[0]); !ok {
+    return false
+  }
+
+  return matchGlobParts(parts[1:], names[1:])
+}
+
+type WalkOptions struct {
+  Include        []string // only files matching any of these globs (or in matching dirs) are walked
+  Exclude        []string // always applied after the ignore files
+  FollowSymlinks bool
+  SkipDirs       []string // abs paths, e.g. the dst dir
+}
+
+// hidden dirs, the skip dirs, and the files and dirs matching the ignore files or the exclude globs aren't walked
+type Walker struct {
+  root    string
+  opts    WalkOptions
+  include []*GlobRule
+  exclude []*GlobRule
+  ignores map[string][]*GlobRule // dir -> rules of its ignore files, read lazily
+  mutex   *sync.Mutex
+}
+
+func NewWalker(root string, opts WalkOptions) (*Walker, error) {
+  w := &Walker{root, opts, make([]*GlobRule, 0), make([]*GlobRule, 0), make(map[string][]*GlobRule), &sync.Mutex{}}
+
+  for _, pattern := range opts.Include {
+    r, err := ParseGlobRule(root, pattern)
+    if err != nil {
+      return nil, errors.New("--include: " + err.Error())
+    }
+
+    w.include = append(w.include, r)
+  }
+
+  for _, pattern := range opts.Exclude {
+    r, err := ParseGlobRule(root, pattern)
+    if err != nil {
+      return nil, errors.New("--exclude: " + err.Error())
+    }
+
+    w.exclude = append(w.exclude, r)
+  }
+
+  return w, nil
+}
+
+// invalid lines are ignored, like git does
+func readIgnoreFile(dir string, name string) ([]*GlobRule, error) {
+  rules := make([]*GlobRule, 0)
+
+  b, err := ioutil.ReadFile(filepath.Join(dir, name))
+  if err != nil {
+    if os.IsNotExist(err) {
+      return rules, nil
+    }
+
+    return nil, err
+  }
+
+  for _, line := range strings.Split(string(b), "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+
+    if r, err := ParseGlobRule(dir, line); err == nil {
+      rules = append(rules, r)
+    }
+  }
+
+  return rules, nil
+}
+
+func (w *Walker) ignoreRules(dir string) []*GlobRule {
+  w.mutex.Lock()
+
+  defer w.mutex.Unlock()
+
+  if rules, ok := w.ignores[dir]; ok {
+    return rules
+  }
+
+  rules := make([]*GlobRule, 0)
+  for _, name := range IGNORE_FILES {
+    // unreadable ignore files are treated as empty
+    if fileRules, err := readIgnoreFile(dir, name); err == nil {
+      rules = append(rules, fileRules...)
+    }
+  }
+
+  w.ignores[dir] = rules
+
+  return rules
+}
+
+// the parent dirs of path are assumed not to be ignored (they aren't descended into by Walk)
+func (w *Walker) IsIgnored(fpath string, isDir bool) bool {
+  if isDir {
+    if strings.HasPrefix(filepath.Base(fpath), ".") {
+      return true
+    }
+
+    for _, dir := range w.opts.SkipDirs {
+      if fpath == dir {
+        return true
+      }
+    }
+  }
+
+  // the rules of the ignore files closer to path take precedence, the last matching rule wins
+  dirs := make([]string, 0)
+  for dir := filepath.Dir(fpath); ; dir = filepath.Dir(dir) {
+    dirs = append([]string{dir}, dirs...)
+
+    if dir == w.root || len(dir) <= 1 {
+      break
+    }
+  }
+
+  ignored := false
+  for _, dir := range dirs {
+    for _, r := range w.ignoreRules(dir) {
+      if r.Match(fpath, isDir) {
+        ignored = !r.negate
+      }
+    }
+  }
+
+  for _, r := range w.exclude {
+    if r.Match(fpath, isDir) {
+      ignored = !r.negate
+    }
+  }
+
+  if ignored || isDir || len(w.include) == 0 {
+    return ignored
+  }
+
+  for _, r := range w.include {
+    for dir := fpath; dir != w.root && len(dir) > 1; dir = filepath.Dir(dir) {
+      if r.Match(dir, dir != fpath) {
+        return false
+      }
+    }
+  }
+
+  return true
+}
+
+// symlinked files are passed with the info of their target
+// symlinked dirs are only followed if FollowSymlinks is set, links to a dir that is being walked (i.e. loops) are skipped
+func (w *Walker) Walk(fn func(path string, info os.FileInfo) error) error {
+  return w.walkDir(w.root, []string{}, fn)
+}
+
+// ancestors are the real paths of the dirs that are being walked
+func (w *Walker) walkDir(dir string, ancestors []string, fn func(path string, info os.FileInfo) error) error {
+  if w.opts.FollowSymlinks {
+    real, err := filepath.EvalSymlinks(dir)
+    if err != nil {
+      return err
+    }
+
+    if ContainsString(ancestors, real) {
+      return nil
+    }
+
+    ancestors = append(ancestors[0:len(ancestors):len(ancestors)], real)
+  }
+
+  infos, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return err
+  }
+
+  for _, info := range infos {
+    fpath := filepath.Join(dir, info.Name())
+
+    if info.Mode() & os.ModeSymlink != 0 {
+      info, err = os.Stat(fpath)
+      if err != nil {
+        // dangling
+        continue
+      }
+
+      if info.IsDir() && !w.opts.FollowSymlinks {
+        continue
+      }
+    }
+
+    if w.IsIgnored(fpath, info.IsDir()) {
+      continue
+    }
+
+    if info.IsDir() {
+      if err := w.walkDir(fpath, ancestors, fn); err != nil {
+        return err
+      }
+    } else {
+      if err := fn(fpath, info); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// walks dir with the default options
+func WalkFiles(dir string, fn func(path string, info os.FileInfo) error) error {
+  w, err := NewWalker(dir, WalkOptions{})
+  if err != nil {
+    return err
+  }
+
+  return w.Walk(fn)
+}
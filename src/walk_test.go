@@ -0,0 +1,192 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "sort"
+  "testing"
+)
+
+func TestGlobRuleMatch(t *testing.T) {
+  tests := []struct {
+    pattern string
+    path    string
+    isDir   bool
+    want    bool
+  }{
+    {"*.o", "/r/a.o", false, true},
+    {"*.o", "/r/a/b/c.o", false, true},
+    {"*.o", "/r/a.c", false, false},
+    {"*.o", "/other/a.o", false, false},
+    {"/build", "/r/build", true, true},
+    {"/build", "/r/a/build", true, false},
+    {"build", "/r/a/build", true, true},
+    {"a/*.c", "/r/a/x.c", false, true},
+    {"a/*.c", "/r/b/a/x.c", false, false},
+    {"a/*.c", "/r/a/b/x.c", false, false},
+    {"out/", "/r/x/out", true, true},
+    {"out/", "/r/x/out", false, false},
+    {"**/gen/*.c", "/r/gen/x.c", false, true},
+    {"**/gen/*.c", "/r/a/b/gen/x.c", false, true},
+    {"a/**", "/r/a/b/c.h", false, true},
+    {"a/**/b", "/r/a/b", true, true},
+    {"a/**/b", "/r/a/x/y/b", true, true},
+    {"a/**/b", "/r/x/a/b", true, false},
+    {"!*.o", "/r/a.o", false, true},
+  }
+
+  for _, test := range tests {
+    r, err := ParseGlobRule("/r", test.pattern)
+    if err != nil {
+      t.Fatalf("%s: %v", test.pattern, err)
+    }
+
+    if got := r.Match(test.path, test.isDir); got != test.want {
+      t.Errorf("%s %s: expected %v, got %v", test.pattern, test.path, test.want, got)
+    }
+  }
+
+  if r, _ := ParseGlobRule("/r", "!*.o"); !r.negate {
+    t.Errorf("expected !*.o to be negated")
+  }
+
+  for _, pattern := range []string{"", "/", "!", "a/[b"} {
+    if _, err := ParseGlobRule("/r", pattern); err == nil {
+      t.Errorf("%q: expected an error", pattern)
+    }
+  }
+}
+
+// empty files are created, along with their parent dirs
+func writeTree(t *testing.T, root string, paths []string) {
+  for _, path := range paths {
+    path = filepath.Join(root, filepath.FromSlash(path))
+
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+      t.Fatal(err)
+    }
+
+    if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+func writeIgnoreFile(t *testing.T, path string, content string) {
+  if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// returns the walked files relative to the root, sorted
+func walkRel(t *testing.T, root string, opts WalkOptions) []string {
+  w, err := NewWalker(root, opts)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  files := make([]string, 0)
+
+  err = w.Walk(func(path string, info os.FileInfo) error {
+    rel, err := filepath.Rel(root, path)
+    if err != nil {
+      return err
+    }
+
+    files = append(files, filepath.ToSlash(rel))
+    return nil
+  })
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  sort.Strings(files)
+
+  return files
+}
+
+func TestWalkerIgnoreFiles(t *testing.T) {
+  root := t.TempDir()
+
+  writeTree(t, root, []string{
+    "a.c", "a.o", "keep.o",
+    "build/b.c", "docs/build",
+    "sub/x.o", "sub/y.o", "sub/main.c", "sub/z.c",
+    ".hidden/h.c", "dst/d.c", "exc/e.c",
+  })
+
+  writeIgnoreFile(t, filepath.Join(root, ".gitignore"), "# objects\n*.o\n!keep.o\nbuild/\n")
+
+  // nested ignore files override their parents, .bakeignore overrides .gitignore
+  writeIgnoreFile(t, filepath.Join(root, "sub", ".gitignore"), "!x.o\n*.c\n")
+  writeIgnoreFile(t, filepath.Join(root, "sub", ".bakeignore"), "!main.c\n")
+
+  got := walkRel(t, root, WalkOptions{Exclude: []string{"exc/"}, SkipDirs: []string{filepath.Join(root, "dst")}})
+  want := []string{".gitignore", "a.c", "docs/build", "keep.o", "sub/.bakeignore", "sub/.gitignore", "sub/main.c", "sub/x.o"}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("expected %v, got %v", want, got)
+  }
+}
+
+func TestWalkerExcludeOverridesIgnoreFiles(t *testing.T) {
+  root := t.TempDir()
+
+  writeTree(t, root, []string{"a.c", "gen/b.c"})
+  writeIgnoreFile(t, filepath.Join(root, ".gitignore"), "gen/\n")
+
+  got := walkRel(t, root, WalkOptions{Exclude: []string{"!gen/"}})
+  want := []string{".gitignore", "a.c", "gen/b.c"}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("expected %v, got %v", want, got)
+  }
+}
+
+func TestWalkerInclude(t *testing.T) {
+  root := t.TempDir()
+
+  writeTree(t, root, []string{"a.c", "a.h", "include/x.h", "include/deep/y.h", "src/b.c", "src/b.h"})
+
+  got := walkRel(t, root, WalkOptions{Include: []string{"*.c", "include/"}})
+  want := []string{"a.c", "include/deep/y.h", "include/x.h", "src/b.c"}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("expected %v, got %v", want, got)
+  }
+}
+
+func TestWalkerSymlinks(t *testing.T) {
+  root := t.TempDir()
+
+  writeTree(t, root, []string{"real/a.c"})
+
+  for link, target := range map[string]string{
+    "link":      "real",            // a second path to the same dir
+    "f.c":       "real/a.c",        // symlinked file
+    "real/loop": "..",              // loop back to the root
+    "real/self": ".",               // loop to itself
+    "dangling":  "does-not-exist",
+  } {
+    if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  got := walkRel(t, root, WalkOptions{})
+  want := []string{"f.c", "real/a.c"}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("without following: expected %v, got %v", want, got)
+  }
+
+  got = walkRel(t, root, WalkOptions{FollowSymlinks: true})
+  want = []string{"f.c", "link/a.c", "real/a.c"}
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("following: expected %v, got %v", want, got)
+  }
+}
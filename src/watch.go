@@ -0,0 +1,375 @@
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  WATCH_DEBOUNCE      = 200*time.Millisecond
+  WATCH_POLL_INTERVAL = 500*time.Millisecond
+)
+
+// reports changed, created and deleted files below root (a dir means that anything below it might have changed)
+// inotify is used on linux, other platforms (or if inotify fails) fall back to polling the mod times
+// changes are collected in a set, so that the reader is never blocked while a build is running
+type Watcher struct {
+  mutex   sync.Mutex
+  pending map[string]bool
+  notify  chan bool
+  errs    chan error
+  close   func() error
+}
+
+// which dirs and files are watched, consistent with the Walker of the project
+type WatchScope struct {
+  Ignore         func(path string) bool
+  FollowSymlinks bool
+}
+
+func NewWatcher(root string, scope *WatchScope) (*Watcher, error) {
+  w := &Watcher{sync.Mutex{}, make(map[string]bool), make(chan bool, 1), make(chan error, 1), nil}
+
+  if err := startNativeWatcher(w, root, scope); err != nil {
+    fmt.Fprintf(os.Stderr, "watching by polling (%s)\n", err.Error())
+
+    if err := startPollWatcher(w, root, scope); err != nil {
+      return nil, err
+    }
+  }
+
+  return w, nil
+}
+
+// never blocks
+func (w *Watcher) Emit(path string) {
+  w.mutex.Lock()
+  w.pending[path] = true
+  w.mutex.Unlock()
+
+  select {
+  case w.notify <- true:
+  default:
+  }
+}
+
+// blocks until something changes, then waits for a quiet period, so that bursts of saves trigger a single build
+func (w *Watcher) Wait() ([]string, error) {
+  select {
+  case <-w.notify:
+  case err := <-w.errs:
+    return nil, err
+  }
+
+  for {
+    select {
+    case <-w.notify:
+    case err := <-w.errs:
+      return nil, err
+    case <-time.After(WATCH_DEBOUNCE):
+      w.mutex.Lock()
+      changed := w.pending
+      w.pending = make(map[string]bool)
+      w.mutex.Unlock()
+
+      paths := make([]string, 0)
+      for path := range changed {
+        paths = append(paths, path)
+      }
+
+      sort.Strings(paths)
+
+      return paths, nil
+    }
+  }
+}
+
+func (w *Watcher) Close() error {
+  return w.close()
+}
+
+// calls fn for every dir below root (including root), ignored dirs aren't descended into
+// symlinked dirs are followed like Walker does
+func walkWatchDirs(dir string, scope *WatchScope, fn func(dir string) error) error {
+  return walkWatchDirsInner(dir, scope, []string{}, fn)
+}
+
+func walkWatchDirsInner(dir string, scope *WatchScope, ancestors []string, fn func(dir string) error) error {
+  if scope.FollowSymlinks {
+    real, err := filepath.EvalSymlinks(dir)
+    if err != nil {
+      return err
+    }
+
+    if ContainsString(ancestors, real) {
+      return nil
+    }
+
+    ancestors = append(ancestors[0:len(ancestors):len(ancestors)], real)
+  }
+
+  if err := fn(dir); err != nil {
+    return err
+  }
+
+  infos, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return err
+  }
+
+  for _, info := range infos {
+    path := filepath.Join(dir, info.Name())
+
+    isDir := info.IsDir()
+    if info.Mode() & os.ModeSymlink != 0 && scope.FollowSymlinks {
+      if stat, err := os.Stat(path); err == nil {
+        isDir = stat.IsDir()
+      }
+    }
+
+    if isDir && !scope.Ignore(path) {
+      if err := walkWatchDirsInner(path, scope, ancestors, fn); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+func scanModTimes(root string, scope *WatchScope) (map[string]time.Time, error) {
+  modTimes := make(map[string]time.Time)
+
+  err := walkWatchDirs(root, scope, func(dir string) error {
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+      // the dir might have been removed in the meantime
+      return nil
+    }
+
+    for _, info := range infos {
+      path := filepath.Join(dir, info.Name())
+
+      // symlinked files are reported with the mod time of their target
+      if info.Mode() & os.ModeSymlink != 0 {
+        if stat, err := os.Stat(path); err == nil {
+          info = stat
+        }
+      }
+
+      if !info.IsDir() && !scope.Ignore(path) {
+        modTimes[path] = info.ModTime()
+      }
+    }
+
+    return nil
+  })
+
+  return modTimes, err
+}
+
+func startPollWatcher(w *Watcher, root string, scope *WatchScope) error {
+  prev, err := scanModTimes(root, scope)
+  if err != nil {
+    return err
+  }
+
+  done := make(chan bool)
+
+  go func() {
+    for {
+      select {
+      case <-done:
+        return
+      case <-time.After(WATCH_POLL_INTERVAL):
+      }
+
+      cur, err := scanModTimes(root, scope)
+      if err != nil {
+        w.errs <- err
+        return
+      }
+
+      for path, modTime := range cur {
+        if prevModTime, ok := prev[path]; !ok || !prevModTime.Equal(modTime) {
+          w.Emit(path)
+        }
+      }
+
+      for path := range prev {
+        if _, ok := cur[path]; !ok {
+          w.Emit(path)
+        }
+      }
+
+      prev = cur
+    }
+  }()
+
+  w.close = func() error {
+    close(done)
+    return nil
+  }
+
+  return nil
+}
+
+// the same files as in source discovery are ignored (e.g. the dst dir, hidden dirs and the .gitignore'd files)
+func (p *CProject) IsWatchIgnored(path string) bool {
+  // also deleted paths below dst
+  if path == p.dstDir || strings.HasPrefix(path, p.dstDir + string(filepath.Separator)) {
+    return true
+  }
+
+  rel, err := filepath.Rel(p.root, path)
+  if err != nil {
+    return true
+  }
+
+  // also hidden files (e.g. editor lock files), and paths below hidden dirs
+  for _, part := range strings.Split(rel, string(filepath.Separator)) {
+    if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+      return true
+    }
+  }
+
+  isDir := false
+  if stat, err := os.Stat(path); err == nil {
+    isDir = stat.IsDir()
+  }
+
+  return p.walker.IsIgnored(path, isDir)
+}
+
+func (p *CProject) WatchScope() *WatchScope {
+  return &WatchScope{p.IsWatchIgnored, p.walker.opts.FollowSymlinks}
+}
+
+// a changed dir is replaced by the known files below it (which might have been removed), and the files that are below it now
+func (p *CProject) expandWatchPaths(paths []string) []string {
+  res := make([]string, 0)
+
+  for _, path := range paths {
+    stat, err := os.Stat(path)
+    isDir := err == nil && stat.IsDir()
+
+    for _, f := range p.files {
+      if strings.HasPrefix(f.Path, path + string(filepath.Separator)) {
+        isDir = true
+        res = append(res, f.Path)
+      }
+    }
+
+    if !isDir {
+      res = append(res, path)
+      continue
+    }
+
+    if modTimes, err := scanModTimes(path, p.WatchScope()); err == nil {
+      for file := range modTimes {
+        res = append(res, file)
+      }
+    }
+  }
+
+  return SortUnique(res)
+}
+
+// re-parses the changed sources and headers, and re-resolves the deps of all files
+// returns the changed paths that are relevant to the build
+func (p *CProject) UpdateFiles(paths []string) ([]string, error) {
+  relevant := make([]string, 0)
+
+  for _, path := range p.expandWatchPaths(paths) {
+    if !p.IsHCFile(path) {
+      continue
+    }
+
+    relevant = append(relevant, path)
+
+    files := FilterFiles(p.files, func(f *File) bool {
+      return f.Path != path
+    })
+
+    // deleted files are simply dropped
+    if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+      f, err := p.ParseCFile(path, stat.ModTime())
+      if err != nil {
+        return nil, err
+      }
+
+      files = append(files, f)
+    }
+
+    p.files = files
+  }
+
+  if len(relevant) == 0 {
+    return relevant, nil
+  }
+
+  for _, f := range p.files {
+    f.Deps = make(map[string]*File)
+  }
+
+  return relevant, p.ResolveDeps()
+}
+
+func (p *CProject) rebuild(target string) error {
+  p.updatedObjs = make([]string, 0)
+
+  if target != "" {
+    return p.BuildTarget(target)
+  } else {
+    return p.Build()
+  }
+}
+
+// build errors are printed, but don't stop watching
+func (p *CProject) Watch(target string) error {
+  w, err := NewWatcher(p.root, p.WatchScope())
+  if err != nil {
+    return err
+  }
+
+  defer w.Close()
+
+  for {
+    if err := p.rebuild(target); err != nil {
+      fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+    }
+
+    // -f/-B only applies to the first build
+    p.force = false
+
+    fmt.Println("watching for changes...")
+
+    for {
+      paths, err := w.Wait()
+      if err != nil {
+        return err
+      }
+
+      changed, err := p.UpdateFiles(paths)
+      if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+        continue
+      }
+
+      if len(changed) > 0 {
+        for i, path := range changed {
+          changed[i] = p.FormatPath(path)
+        }
+
+        fmt.Printf("\n======== %s %s ========\n", time.Now().Format("15:04:05"), strings.Join(changed, " "))
+        break
+      }
+    }
+  }
+}
@@ -0,0 +1,134 @@
+// +build linux
+
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "unsafe"
+)
+
+const (
+  INOTIFY_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+func startNativeWatcher(w *Watcher, root string, scope *WatchScope) error {
+  fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+  if err != nil {
+    return os.NewSyscallError("inotify_init1", err)
+  }
+
+  // a dir reached via several symlinks has a single watch
+  dirs := make(map[int32][]string)
+
+  addDirs := func(dirs map[int32][]string, dir string) error {
+    return walkWatchDirs(dir, scope, func(dir string) error {
+      wd, err := syscall.InotifyAddWatch(fd, dir, INOTIFY_MASK)
+      if err != nil {
+        return os.NewSyscallError("inotify_add_watch", err)
+      }
+
+      if !ContainsString(dirs[int32(wd)], dir) {
+        dirs[int32(wd)] = append(dirs[int32(wd)], dir)
+      }
+
+      return nil
+    })
+  }
+
+  // the paths of moved dirs are stale, and removed dirs might not have been reported (after a queue overflow)
+  rescan := func() error {
+    fresh := make(map[int32][]string)
+
+    if err := addDirs(fresh, root); err != nil {
+      return err
+    }
+
+    for wd := range dirs {
+      if _, ok := fresh[wd]; !ok {
+        syscall.InotifyRmWatch(fd, uint32(wd))
+      }
+    }
+
+    dirs = fresh
+
+    return nil
+  }
+
+  if err := addDirs(dirs, root); err != nil {
+    syscall.Close(fd)
+    return err
+  }
+
+  go func() {
+    buf := make([]byte, 64*1024)
+
+    for {
+      n, err := syscall.Read(fd, buf)
+      if err == syscall.EINTR {
+        continue
+      } else if err != nil || n <= 0 {
+        // also happens when fd is closed
+        return
+      }
+
+      for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+        ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+        name := string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(ev.Len)])
+        offset += syscall.SizeofInotifyEvent + int(ev.Len)
+
+        if ev.Mask & syscall.IN_Q_OVERFLOW != 0 {
+          // events were lost, so everything might have changed
+          if err := rescan(); err != nil && !os.IsNotExist(err) {
+            w.errs <- err
+            return
+          }
+
+          w.Emit(root)
+          continue
+        } else if ev.Mask & syscall.IN_IGNORED != 0 {
+          delete(dirs, ev.Wd)
+          continue
+        }
+
+        // copied, because rescan replaces the map
+        paths := make([]string, 0)
+        for _, dir := range dirs[ev.Wd] {
+          paths = append(paths, filepath.Join(dir, strings.TrimRight(name, "\x00")))
+        }
+
+        for _, path := range paths {
+          if scope.Ignore(path) {
+            continue
+          }
+
+          if ev.Mask & syscall.IN_ISDIR != 0 {
+            // files in new dirs might have been created before the watch was added
+            if ev.Mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0 {
+              err = addDirs(dirs, path)
+            } else if ev.Mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0 {
+              err = rescan()
+            }
+
+            // the dir was removed again in the meantime, which is reported by another event
+            if err != nil && !os.IsNotExist(err) {
+              w.errs <- err
+              return
+            }
+          }
+
+          // a dir stands for all the files below it
+          w.Emit(path)
+        }
+      }
+    }
+  }()
+
+  w.close = func() error {
+    return syscall.Close(fd)
+  }
+
+  return nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import (
+  "errors"
+)
+
+func startNativeWatcher(w *Watcher, root string, scope *WatchScope) error {
+  return errors.New("inotify is only available on linux")
+}